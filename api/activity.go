@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Activity kinds recorded in the pet_activity table.
+const (
+	activityPetCreated   = "pet_created"
+	activityCoOwnerAdded = "co_owner_added"
+	activityMoneySpent   = "money_spent"
+	activityPetRenamed   = "pet_renamed"
+	activityStateChanged = "state_changed"
+	activityLevelUp      = "level_up"
+	activityEvolved      = "evolved"
+	activityCare         = "care"
+	activityMinigame     = "minigame"
+
+	activityVacationStarted = "vacation_started"
+	activityVacationEnded   = "vacation_ended"
+	activityGiftSent        = "gift_sent"
+	activityGiftReceived    = "gift_received"
+	activityItemBought      = "item_bought"
+	activityChestBought     = "chest_bought"
+	activityChestOpened     = "chest_opened"
+	activityStreakClaimed   = "streak_claimed"
+
+	activitySpendingRequested     = "spending_requested"
+	activitySpendingApproved      = "spending_approved"
+	activitySpendingDenied        = "spending_denied"
+	activitySpendingPolicyChanged = "spending_policy_changed"
+)
+
+// activityEntry is one line of a pet's activity feed.
+type activityEntry struct {
+	ID        int64                  `json:"id"`
+	PetID     int                    `json:"pet_id"`
+	ActorID   *int                   `json:"actor_id"`
+	Kind      string                 `json:"kind"`
+	Message   string                 `json:"message"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// userDisplayName returns the name used for a user in feed messages: their display name if
+// set, otherwise their username.
+// Parameters:
+// - q: The database or transaction to read from.
+// - userID: The ID of the user.
+// Returns:
+// - The name, or "Someone" if the user cannot be read.
+func userDisplayName(q sqlExecutor, userID int) string {
+	var name string
+	if err := q.QueryRow("SELECT COALESCE(NULLIF(display_name, ''), username) FROM users WHERE id = ?", userID).Scan(&name); err != nil {
+		return "Someone"
+	}
+	return name
+}
+
+// recordActivity appends an entry to a pet's activity feed. Callers running inside a
+// transaction should pass the transaction and call publishActivity once it commits.
+// Parameters:
+// - q: The database or transaction to write to.
+// - petID: The ID of the pet.
+// - actorID: The ID of the user who acted, or 0 for server-initiated events.
+// - kind: One of the activity* kinds.
+// - message: The human-readable feed line.
+// - data: Optional structured details for clients.
+// Returns:
+// - The stored entry.
+// - An error if the insert fails.
+func recordActivity(q sqlExecutor, petID int, actorID int, kind, message string, data map[string]interface{}) (*activityEntry, error) {
+	entry := &activityEntry{PetID: petID, Kind: kind, Message: message, Data: data, CreatedAt: time.Now().UTC()}
+	var actor sql.NullInt64
+	if actorID != 0 {
+		entry.ActorID = &actorID
+		actor = sql.NullInt64{Int64: int64(actorID), Valid: true}
+	}
+	var dataJSON sql.NullString
+	if len(data) > 0 {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		dataJSON = sql.NullString{String: string(b), Valid: true}
+	}
+
+	res, err := q.Exec("INSERT INTO pet_activity (pet_id, actor_id, kind, message, data, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		petID, actor, kind, message, dataJSON, entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// publishActivity streams a recorded entry to every connected owner of its pet.
+// Parameters:
+// - entry: The entry to publish. A nil entry is ignored.
+func publishActivity(entry *activityEntry) {
+	if entry == nil {
+		return
+	}
+	pet, err := loadPet(db, entry.PetID)
+	if err != nil {
+		logMessage("activity_publish_error", map[string]interface{}{"error": err.Error(), "pet_id": entry.PetID})
+		return
+	}
+	sendToOwners(pet, activityMessage(entry))
+}
+
+// activityMessage builds the ActivityEvent message for an entry.
+func activityMessage(entry *activityEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "ActivityEvent",
+		"activity": entry,
+	}
+}
+
+// logPetActivity records an activity entry outside of any transaction and publishes it.
+// Failures are logged rather than returned because the feed is informational.
+// Parameters:
+// - petID: The ID of the pet.
+// - actorID: The ID of the user who acted, or 0 for server-initiated events.
+// - kind: One of the activity* kinds.
+// - message: The human-readable feed line.
+// - data: Optional structured details for clients.
+func logPetActivity(petID int, actorID int, kind, message string, data map[string]interface{}) {
+	entry, err := recordActivity(db, petID, actorID, kind, message, data)
+	if err != nil {
+		logMessage("activity_record_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "kind": kind})
+		return
+	}
+	publishActivity(entry)
+}
+
+// petActivityHandler returns a page of a pet's activity feed, newest first.
+// Endpoint: GET /pets/{id}/activity?limit=<n>&offset=<n>&before=<entry id>
+// Passing the id of the oldest entry already shown as "before" keeps pages stable while new
+// entries keep arriving.
+// Response:
+// - 200 OK with the entries.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func petActivityHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can read a pet's activity", http.StatusForbidden)
+		return
+	}
+
+	limit, offset := parsePagination(r)
+	before, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	if err != nil || before <= 0 {
+		before = 1<<63 - 1
+	}
+
+	rows, err := db.Query("SELECT id, actor_id, kind, message, data, created_at FROM pet_activity WHERE pet_id = ? AND id < ? ORDER BY id DESC LIMIT ? OFFSET ?",
+		petID, before, limit+1, offset)
+	if err != nil {
+		logMessage("pet_activity_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading activity", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []activityEntry{}
+	for rows.Next() {
+		entry := activityEntry{PetID: petID}
+		var actor sql.NullInt64
+		var data sql.NullString
+		if err := rows.Scan(&entry.ID, &actor, &entry.Kind, &entry.Message, &data, &entry.CreatedAt); err != nil {
+			logMessage("pet_activity_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+			http.Error(w, "Error reading activity", http.StatusInternalServerError)
+			return
+		}
+		if actor.Valid {
+			id := int(actor.Int64)
+			entry.ActorID = &id
+		}
+		if data.Valid {
+			_ = json.Unmarshal([]byte(data.String), &entry.Data)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading activity", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(entries) > limit
+	if hasMore {
+		entries = entries[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    entries,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
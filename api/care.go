@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Care actions sent over /ws as the message type.
+const (
+	careFeed = "feed"
+	carePlay = "play"
+	careHeal = "heal"
+)
+
+// defaultCareItems is used when a care message does not name an item.
+var defaultCareItems = map[string]string{
+	careFeed: "apple",
+	carePlay: "teddy_bear",
+	careHeal: "potion",
+}
+
+// careMessages are the feed lines for each action: actor, pet name, item label.
+var careMessages = map[string]string{
+	careFeed: "%s fed %s %s",
+	carePlay: "%s played with %s using %s",
+	careHeal: "%s gave %s %s",
+}
+
+// careAffinity returns the species multiplier for a care action.
+func careAffinity(sp *speciesRecord, action string) float64 {
+	switch action {
+	case careFeed:
+		return sp.FoodAffinity
+	case carePlay:
+		return sp.PlayAffinity
+	case careHeal:
+		return sp.HealAffinity
+	}
+	return 1
+}
+
+// careFail replies to a care message with a failure.
+func careFail(conn *websocket.Conn, action, message string) {
+	writeConn(conn, map[string]interface{}{
+		"type":    "CareResponse",
+		"action":  action,
+		"status":  "fail",
+		"message": message,
+	})
+}
+
+// careRefusal is returned by useItemTx when the pet cannot be given the item. Message is
+// shown to the caller; Status is the HTTP status POST /shop/buy answers with.
+type careRefusal struct {
+	Status  int
+	Message string
+}
+
+func (e *careRefusal) Error() string {
+	return e.Message
+}
+
+// careResult is what useItemTx changed, for publishing once the transaction commits.
+type careResult struct {
+	Pet           *petRecord
+	Item          *shopItem
+	Amount        int  // points restored after the species affinity
+	FromInventory bool // the item came from the pet's inventory instead of the shop
+	Remaining     int  // how many of the item the inventory still holds
+	Entry         *activityEntry
+	Vacation      *petVacation
+	VacationEntry *activityEntry
+	Progress      *progressResult
+	Streak        *petStreak // set on the pet's first care action of the day
+	PreviousMood  string
+	MoodChanged   bool
+}
+
+// chargeItemTx pays for items from a pet's money: it checks the item is on sale and
+// unlocked, takes it from stock, deducts the price and records the ledger entry.
+// Parameters:
+// - tx: The transaction to run in.
+// - pet: The paying pet.
+// - userID: The ID of the owner buying.
+// - item: The item, as loaded from the catalog.
+// - quantity: How many to buy.
+// - reason: The ledger reason, txReasonCare or txReasonPurchase.
+// - now: The current time.
+// Returns:
+// - A *careRefusal if the item cannot be bought, or another error if a query fails.
+func chargeItemTx(tx *sql.Tx, pet *petRecord, userID int, item *shopItem, quantity int, reason string, now time.Time) error {
+	if !item.onSale(now) {
+		return &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s is not on sale", item.DisplayName)}
+	}
+	if pet.Level < item.MinLevel {
+		return &careRefusal{Status: http.StatusForbidden, Message: fmt.Sprintf("%s unlocks at level %d", item.DisplayName, item.MinLevel)}
+	}
+	if err := checkSpendingTx(tx, pet, userID, item.Price*quantity, now); err != nil {
+		return err
+	}
+	// Unlimited stock is NULL, and NULL minus anything stays NULL.
+	res, err := tx.Exec("UPDATE items SET stock = stock - ? WHERE id = ? AND (stock IS NULL OR stock >= ?)", quantity, item.ID, quantity)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s is sold out", item.DisplayName)}
+	}
+	cost := item.Price * quantity
+	res, err = tx.Exec("UPDATE pets SET money = money - ? WHERE id = ? AND money >= ?", cost, pet.ID, cost)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if quantity == 1 {
+			return &careRefusal{Status: http.StatusPaymentRequired, Message: fmt.Sprintf("Insufficient funds: %s costs %d coins", item.Label, item.Price)}
+		}
+		return &careRefusal{Status: http.StatusPaymentRequired, Message: fmt.Sprintf("Insufficient funds: %d %s cost %d coins", quantity, item.DisplayName, cost)}
+	}
+	_, err = recordTransaction(tx, pet.ID, userID, -cost, reason, item.ID)
+	return err
+}
+
+// useItemTx gives an item to a pet. One from the pet's inventory is used if it has any;
+// otherwise, unless inventoryOnly is set, one is bought from the shop with the pet's money.
+// The effect is applied, clamped to 100, followed by the feed entry, XP, mood and stats
+// sample of a care action.
+// Parameters:
+// - tx: The transaction to run in.
+// - petID: The ID of the pet.
+// - userID: The ID of the owner giving the item.
+// - item: The item, as loaded from the catalog.
+// - inventoryOnly: Refuse instead of buying when the inventory has none.
+// - now: The current time.
+// Returns:
+// - What changed, for publishCare.
+// - A *careRefusal if the item cannot be given right now, or another error if a query fails.
+func useItemTx(tx *sql.Tx, petID, userID int, item *shopItem, inventoryOnly bool, now time.Time) (*careResult, error) {
+	action := item.action()
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		return nil, err
+	}
+	if !pet.isOwner(userID) {
+		return nil, &careRefusal{Status: http.StatusForbidden, Message: "Only owners can care for a pet"}
+	}
+	switch pet.State {
+	case statePassedAway:
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has passed away", pet.Name)}
+	case stateFainted:
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has fainted and needs to be revived", pet.Name)}
+	}
+	if action == carePlay {
+		asleep, err := petAsleep(tx, pet, now)
+		if err != nil {
+			return nil, err
+		}
+		if asleep {
+			return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s is sleeping", pet.Name)}
+		}
+	}
+
+	sp, err := scanSpecies(tx.QueryRow("SELECT "+speciesColumns+" FROM species WHERE id = ?", pet.Species))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	amount := item.Magnitude
+	if sp != nil {
+		amount = int(math.Round(float64(item.Magnitude) * careAffinity(sp, action)))
+	}
+
+	result := &careResult{Item: item, Amount: amount}
+	remaining, owned, err := takeFromInventoryTx(tx, petID, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case owned:
+		result.FromInventory, result.Remaining = true, remaining
+	case inventoryOnly:
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has no %s left", pet.Name, item.DisplayName)}
+	default:
+		if err := chargeItemTx(tx, pet, userID, item, 1, txReasonCare, now); err != nil {
+			return nil, err
+		}
+	}
+	// item.Effect is constrained by the items table, never taken from the client.
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE pets SET %[1]s = MIN(%[2]d, %[1]s + ?) WHERE id = ?", item.Effect, maxStat), amount, petID); err != nil {
+		return nil, err
+	}
+
+	if pet, err = loadPet(tx, petID); err != nil {
+		return nil, err
+	}
+	result.Pet = pet
+	cost := item.Price
+	if result.FromInventory {
+		cost = 0
+	}
+	result.Entry, err = recordActivity(tx, petID, userID, activityCare,
+		fmt.Sprintf(careMessages[action], userDisplayName(tx, userID), pet.Name, item.Label),
+		map[string]interface{}{"action": action, "item": item.ID, "amount": amount, "cost": cost, "from_inventory": result.FromInventory})
+	if err != nil {
+		return nil, err
+	}
+	result.Vacation, result.VacationEntry, err = endVacationTx(tx, pet, userID, vacationEndedOnInteract, now)
+	if err != nil {
+		return nil, err
+	}
+	if result.Progress, err = awardXPTx(tx, pet, xpRewards[action], userID); err != nil {
+		return nil, err
+	}
+	if result.Streak, err = recordCareDayTx(tx, pet, now); err != nil {
+		return nil, err
+	}
+	if result.PreviousMood, result.MoodChanged, err = updateMoodTx(tx, pet, now); err != nil {
+		return nil, err
+	}
+	if err := recordStatSample(tx, pet, now); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// publishCare pushes the effects of a committed useItemTx to the pet's owners.
+// Parameters:
+// - result: What useItemTx changed.
+// - exceptUserID: An owner who already has the new stats in their response, or 0.
+func publishCare(result *careResult, exceptUserID int) {
+	pet := result.Pet
+	if result.Item.Effect == "happiness" {
+		if err := recordLeaderboardScore(db, "happiness", pet.ID, pet.Happiness); err != nil {
+			logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		}
+	}
+	stats := petStatsMessage(pet)
+	for _, ownerID := range pet.ownerIDs() {
+		if ownerID != exceptUserID {
+			sendToUser(ownerID, stats)
+		}
+	}
+	if result.FromInventory {
+		publishInventory(pet, result.Item.ID, result.Remaining)
+	}
+	publishActivity(result.Entry)
+	publishVacationEnded(pet, result.Vacation, result.VacationEntry)
+	publishProgress(pet, result.Progress)
+	publishStreak(pet, result.Streak)
+	if result.MoodChanged {
+		publishMood(pet, result.PreviousMood)
+	}
+}
+
+// handleCare applies a Feed, Play or Heal message to the caller's pet through useItemTx,
+// using an item from the pet's inventory when it has one.
+// The caller receives a CareResponse with the new stats; co-owners receive a PetStatsUpdate.
+// A message repeating an earlier idempotency_key is answered with the earlier response.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - action: One of careFeed, carePlay or careHeal.
+// - message: The raw message, which may name an "item" and must carry an "idempotency_key".
+func handleCare(conn *websocket.Conn, userID int, action string, message []byte) {
+	var req struct {
+		Item string `json:"item"`
+	}
+	_ = json.Unmarshal(message, &req)
+	key := idempotencyKey(message)
+	if key == "" {
+		careFail(conn, action, "idempotency_key is required")
+		return
+	}
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+	if req.Item == "" {
+		req.Item = defaultCareItems[action]
+	}
+	item, err := loadItem(db, req.Item)
+	if err != nil && err != sql.ErrNoRows {
+		logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "item": req.Item})
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+	if err == sql.ErrNoRows || item.action() != action {
+		careFail(conn, action, fmt.Sprintf("%s cannot be used to %s", req.Item, action))
+		return
+	}
+
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			careFail(conn, action, "Caller has no pet")
+			return
+		}
+		logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+	// Apply pending decay first so the effect lands on the pet's current stats.
+	if _, err := refreshPet(petID); err != nil {
+		logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := useItemTx(tx, petID, userID, item, false, time.Now())
+	if err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			careFail(conn, action, refusal.Message)
+			return
+		}
+		logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+	response := map[string]interface{}{
+		"type":           "CareResponse",
+		"action":         action,
+		"item":           item.ID,
+		"status":         "success",
+		"pet":            petData(result.Pet),
+		"from_inventory": result.FromInventory,
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, response); err != nil {
+		tx.Rollback()
+		if err == errDuplicateRequest {
+			replayIdempotentResponse(conn, userID, key)
+			return
+		}
+		logMessage("pet_care_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		careFail(conn, action, "Server error occurred")
+		return
+	}
+
+	writeConn(conn, response)
+	publishCare(result, userID)
+	logMessage("pet_care", map[string]interface{}{"pet_id": petID, "user_id": userID, "action": action, "item": item.ID, "amount": result.Amount})
+}
@@ -0,0 +1,866 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Rarity tiers, from most to least common.
+const (
+	tierCommon    = "common"
+	tierRare      = "rare"
+	tierEpic      = "epic"
+	tierLegendary = "legendary"
+)
+
+// chestTierRanks orders the rarity tiers; a higher rank is rarer.
+var chestTierRanks = map[string]int{
+	tierCommon:    0,
+	tierRare:      1,
+	tierEpic:      2,
+	tierLegendary: 3,
+}
+
+// Kinds of chest drop.
+const (
+	dropCoins    = "coins"
+	dropItem     = "item"
+	dropCosmetic = "cosmetic"
+)
+
+const (
+	// levelUpChest is granted to a pet for every level it gains.
+	levelUpChest = "basic"
+	// maxChestsPerPurchase bounds the quantity of POST /chests/{chest}/buy.
+	maxChestsPerPurchase = 10
+	// maxClientSeedLength bounds the client_seed of POST /chests/{chest}/open.
+	maxClientSeedLength = 64
+)
+
+// chestDrop is one possible result of a roll within a tier. Amount is the coins paid for
+// coins, the quantity for items, and the coins paid instead of a cosmetic the pet already
+// has, or instead of items that would overflow the pet's stack.
+type chestDrop struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"`
+	Amount int    `json:"amount"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// chestTier is a rarity tier of a chest and the drops it can roll.
+type chestTier struct {
+	Name   string      `json:"tier"`
+	Weight int         `json:"weight"`
+	Drops  []chestDrop `json:"drops"`
+}
+
+// chestType is a kind of chest. After PityAfter-1 openings in a row without a drop of
+// PityTier or rarer, the next opening only rolls among those tiers.
+type chestType struct {
+	DisplayName string
+	Price       int
+	PityTier    string
+	PityAfter   int
+	Tiers       []chestTier // most to least common
+}
+
+// chestTypes are the chests that can be bought or earned, keyed by id.
+var chestTypes = map[string]chestType{
+	"basic": {
+		DisplayName: "Basic Chest",
+		Price:       20,
+		PityTier:    tierRare,
+		PityAfter:   10,
+		Tiers: []chestTier{
+			{Name: tierCommon, Weight: 70, Drops: []chestDrop{
+				{Kind: dropCoins, Amount: 5, Weight: 3},
+				{Kind: dropCoins, Amount: 10, Weight: 2},
+				{Kind: dropItem, ID: "apple", Amount: 2, Weight: 3},
+				{Kind: dropItem, ID: "teddy_bear", Amount: 1, Weight: 2},
+			}},
+			{Name: tierRare, Weight: 25, Drops: []chestDrop{
+				{Kind: dropCoins, Amount: 25, Weight: 2},
+				{Kind: dropItem, ID: "potion", Amount: 2, Weight: 1},
+				{Kind: dropItem, ID: "cake", Amount: 1, Weight: 1},
+			}},
+			{Name: tierEpic, Weight: 4, Drops: []chestDrop{
+				{Kind: dropCoins, Amount: 60, Weight: 1},
+				{Kind: dropItem, ID: "golden_apple", Amount: 1, Weight: 1},
+				{Kind: dropCosmetic, ID: "bow", Amount: 30, Weight: 1},
+			}},
+			{Name: tierLegendary, Weight: 1, Drops: []chestDrop{
+				{Kind: dropCoins, Amount: 150, Weight: 1},
+				{Kind: dropItem, ID: "rocket_toy", Amount: 1, Weight: 1},
+				{Kind: dropCosmetic, ID: "crown", Amount: 80, Weight: 1},
+			}},
+		},
+	},
+}
+
+// chestRolls derives an opening's two rolls, each in [0, 1), from the server seed, the
+// client seed and the nonce: HMAC-SHA256 keyed with the server seed over
+// "<client_seed>:<nonce>", with the first and second big-endian uint32 of the digest
+// divided by 2^32.
+func chestRolls(serverSeed, clientSeed string, nonce int) (tierRoll, dropRoll float64) {
+	mac := hmac.New(sha256.New, []byte(serverSeed))
+	fmt.Fprintf(mac, "%s:%d", clientSeed, nonce)
+	sum := mac.Sum(nil)
+	return float64(binary.BigEndian.Uint32(sum[0:4])) / 4294967296, float64(binary.BigEndian.Uint32(sum[4:8])) / 4294967296
+}
+
+// roll picks a tier and a drop. Tiers below minRank are left out, and the weights of the
+// rest are walked in order until they pass roll * total weight.
+// Parameters:
+// - tierRoll, dropRoll: The rolls from chestRolls.
+// - minRank: The lowest tier rank allowed; 0 allows every tier.
+// Returns:
+// - The tier and the drop.
+func (c chestType) roll(tierRoll, dropRoll float64, minRank int) (chestTier, chestDrop) {
+	var tiers []chestTier
+	total := 0
+	for _, t := range c.Tiers {
+		if chestTierRanks[t.Name] >= minRank {
+			tiers = append(tiers, t)
+			total += t.Weight
+		}
+	}
+	tier := tiers[len(tiers)-1]
+	target, sum := tierRoll*float64(total), 0
+	for _, t := range tiers {
+		sum += t.Weight
+		if target < float64(sum) {
+			tier = t
+			break
+		}
+	}
+
+	total = 0
+	for _, d := range tier.Drops {
+		total += d.Weight
+	}
+	drop := tier.Drops[len(tier.Drops)-1]
+	target, sum = dropRoll*float64(total), 0
+	for _, d := range tier.Drops {
+		sum += d.Weight
+		if target < float64(sum) {
+			drop = d
+			break
+		}
+	}
+	return tier, drop
+}
+
+// chestSeed is a user's server seed. Only its hash is shown until it is revealed.
+type chestSeed struct {
+	ID         int64
+	ServerSeed string
+	SeedHash   string
+	Nonce      int
+	CreatedAt  time.Time
+	RevealedAt *time.Time
+}
+
+// public returns the seed as shown to its user: the server seed only once revealed.
+func (s *chestSeed) public() map[string]interface{} {
+	out := map[string]interface{}{
+		"seed_hash":   s.SeedHash,
+		"nonce":       s.Nonce,
+		"created_at":  s.CreatedAt,
+		"revealed_at": s.RevealedAt,
+	}
+	if s.RevealedAt != nil {
+		out["server_seed"] = s.ServerSeed
+	}
+	return out
+}
+
+// activeChestSeed returns the user's unrevealed server seed, committing a new one if the
+// user has none. Concurrent first calls insert at most one seed; the others read it back.
+// Parameters:
+// - q: The database or transaction to use.
+// - userID: The ID of the user.
+// Returns:
+// - The active seed.
+// - An error if a query fails.
+func activeChestSeed(q sqlExecutor, userID int) (*chestSeed, error) {
+	s, err := scanActiveChestSeed(q, userID)
+	if err != sql.ErrNoRows {
+		return s, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	serverSeed := hex.EncodeToString(b)
+	hash := sha256.Sum256([]byte(serverSeed))
+	// The unique index on unrevealed seeds makes a losing insert a no-op.
+	if _, err := q.Exec("INSERT INTO chest_seeds (user_id, server_seed, seed_hash, nonce, created_at) VALUES (?, ?, ?, 0, ?) ON CONFLICT DO NOTHING",
+		userID, serverSeed, hex.EncodeToString(hash[:]), time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return scanActiveChestSeed(q, userID)
+}
+
+// scanActiveChestSeed reads the user's unrevealed server seed.
+func scanActiveChestSeed(q sqlExecutor, userID int) (*chestSeed, error) {
+	s := &chestSeed{}
+	err := q.QueryRow("SELECT id, server_seed, seed_hash, nonce, created_at FROM chest_seeds WHERE user_id = ? AND revealed_at IS NULL", userID).
+		Scan(&s.ID, &s.ServerSeed, &s.SeedHash, &s.Nonce, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// grantChestsTx adds chests to a pet's stash.
+// Parameters:
+// - q: The transaction to run in.
+// - petID: The ID of the pet.
+// - chestID: The chest id.
+// - quantity: How many to add.
+// Returns:
+// - An error if the write fails.
+func grantChestsTx(q sqlExecutor, petID int, chestID string, quantity int) error {
+	_, err := q.Exec(`INSERT INTO pet_chests (pet_id, chest_id, quantity) VALUES (?, ?, ?)
+		ON CONFLICT (pet_id, chest_id) DO UPDATE SET quantity = quantity + excluded.quantity`, petID, chestID, quantity)
+	return err
+}
+
+// petChests returns how many of each chest a pet holds.
+func petChests(q sqlExecutor, petID int) (map[string]int, error) {
+	rows, err := q.Query("SELECT chest_id, quantity FROM pet_chests WHERE pet_id = ? AND quantity > 0", petID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	owned := map[string]int{}
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		owned[id] = n
+	}
+	return owned, rows.Err()
+}
+
+// chestPity returns how many chests of a kind the user has opened since their last drop of
+// the chest's pity tier or rarer.
+func chestPity(q sqlExecutor, userID int, chestID string, c chestType) (int, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM chest_openings WHERE user_id = ? AND chest_id = ? AND id > COALESCE(
+		(SELECT MAX(id) FROM chest_openings WHERE user_id = ? AND chest_id = ? AND tier_rank >= ?), 0)`,
+		userID, chestID, userID, chestID, chestTierRanks[c.PityTier]).Scan(&n)
+	return n, err
+}
+
+// ownsCosmetic reports whether a pet already has a cosmetic, from a chest or from its level.
+func ownsCosmetic(q sqlExecutor, p *petRecord, cosmeticID string) (bool, error) {
+	for _, u := range levelUnlocks {
+		if u.Kind == "cosmetic" && u.ID == cosmeticID && u.Level <= p.Level {
+			return true, nil
+		}
+	}
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM pet_cosmetics WHERE pet_id = ? AND cosmetic_id = ?", p.ID, cosmeticID).Scan(&n)
+	return n > 0, err
+}
+
+// chestOpening is the audit record of one opened chest.
+type chestOpening struct {
+	ID         int64     `json:"id"`
+	ChestID    string    `json:"chest"`
+	PetID      int       `json:"pet_id"`
+	SeedHash   string    `json:"seed_hash"`
+	ServerSeed string    `json:"server_seed,omitempty"` // only once the seed is revealed
+	ClientSeed string    `json:"client_seed"`
+	Nonce      int       `json:"nonce"`
+	Pity       int       `json:"pity"` // openings without a pity-tier drop before this one
+	Tier       string    `json:"tier"`
+	Drop       chestDrop `json:"drop"`
+	Duplicate  bool      `json:"duplicate"` // the drop was paid out as Drop.Amount coins instead
+	Coins      int       `json:"coins"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// chestResult is what openChestTx changed, for publishing once the transaction commits.
+type chestResult struct {
+	Opening   *chestOpening
+	Pet       *petRecord
+	ItemTotal int // the new size of the pet's stack, for item drops
+	Entry     *activityEntry
+}
+
+// openChestTx opens one of a pet's chests: it takes the chest, rolls it with the user's
+// committed seed, pays out the drop and records the opening.
+// Parameters:
+// - tx: The transaction to run in.
+// - pet: The pet whose chest is opened.
+// - userID: The ID of the owner opening it.
+// - chestID: The chest id.
+// - clientSeed: The caller's seed for this opening.
+// - now: The current time.
+// Returns:
+// - What changed, for publishing.
+// - A *careRefusal if the pet has no such chest, or another error if a query fails.
+func openChestTx(tx *sql.Tx, pet *petRecord, userID int, chestID, clientSeed string, now time.Time) (*chestResult, error) {
+	c := chestTypes[chestID]
+	var left int
+	err := tx.QueryRow("UPDATE pet_chests SET quantity = quantity - 1 WHERE pet_id = ? AND chest_id = ? AND quantity > 0 RETURNING quantity",
+		pet.ID, chestID).Scan(&left)
+	if err == sql.ErrNoRows {
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has no %s", pet.Name, c.DisplayName)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := activeChestSeed(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRow("UPDATE chest_seeds SET nonce = nonce + 1 WHERE id = ? RETURNING nonce - 1", seed.ID).Scan(&seed.Nonce); err != nil {
+		return nil, err
+	}
+	pity, err := chestPity(tx, userID, chestID, c)
+	if err != nil {
+		return nil, err
+	}
+	minRank := 0
+	if pity >= c.PityAfter-1 {
+		minRank = chestTierRanks[c.PityTier]
+	}
+	tierRoll, dropRoll := chestRolls(seed.ServerSeed, clientSeed, seed.Nonce)
+	tier, drop := c.roll(tierRoll, dropRoll, minRank)
+
+	o := &chestOpening{ChestID: chestID, PetID: pet.ID, SeedHash: seed.SeedHash, ClientSeed: clientSeed, Nonce: seed.Nonce,
+		Pity: pity, Tier: tier.Name, Drop: drop, CreatedAt: now.UTC()}
+	result := &chestResult{Opening: o}
+	var won string
+	switch drop.Kind {
+	case dropCoins:
+		o.Coins = drop.Amount
+		won = fmt.Sprintf("%d coins", drop.Amount)
+	case dropItem:
+		item, err := loadItem(tx, drop.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.ItemTotal, err = addToInventoryTx(tx, pet.ID, item, drop.Amount, now)
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			// A full stack is paid out at the shop price instead.
+			o.Duplicate, o.Coins = true, item.Price*drop.Amount
+			won = fmt.Sprintf("%d coins instead of %s", o.Coins, item.DisplayName)
+		} else if err != nil {
+			return nil, err
+		} else {
+			won = item.DisplayName
+			if drop.Amount > 1 {
+				won = fmt.Sprintf("%d × %s", drop.Amount, item.DisplayName)
+			}
+		}
+	case dropCosmetic:
+		owned, err := ownsCosmetic(tx, pet, drop.ID)
+		if err != nil {
+			return nil, err
+		}
+		if owned {
+			o.Duplicate, o.Coins = true, drop.Amount
+			won = fmt.Sprintf("%d coins instead of a duplicate %s", drop.Amount, drop.ID)
+		} else {
+			if _, err := tx.Exec("INSERT INTO pet_cosmetics (pet_id, cosmetic_id, source, acquired_at) VALUES (?, ?, ?, ?)",
+				pet.ID, drop.ID, chestID, o.CreatedAt); err != nil {
+				return nil, err
+			}
+			won = fmt.Sprintf("the %s cosmetic", drop.ID)
+		}
+	}
+
+	res, err := tx.Exec(`INSERT INTO chest_openings (user_id, pet_id, chest_id, seed_id, client_seed, nonce, pity, tier, tier_rank,
+		drop_kind, drop_id, amount, duplicate, coins, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, pet.ID, chestID, seed.ID, clientSeed, seed.Nonce, pity, tier.Name, chestTierRanks[tier.Name],
+		drop.Kind, sql.NullString{String: drop.ID, Valid: drop.ID != ""}, drop.Amount, o.Duplicate, o.Coins, o.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	o.ID, _ = res.LastInsertId()
+	if o.Coins > 0 {
+		if _, err := tx.Exec("UPDATE pets SET money = money + ? WHERE id = ?", o.Coins, pet.ID); err != nil {
+			return nil, err
+		}
+		if _, err := recordTransaction(tx, pet.ID, userID, o.Coins, txReasonChestReward, strconv.FormatInt(o.ID, 10)); err != nil {
+			return nil, err
+		}
+		if err := recordLeaderboardScore(tx, "coins_earned", pet.ID, o.Coins); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.Pet, err = loadPet(tx, pet.ID); err != nil {
+		return nil, err
+	}
+	result.Entry, err = recordActivity(tx, pet.ID, userID, activityChestOpened,
+		fmt.Sprintf("%s opened a %s for %s and found %s (%s)", userDisplayName(tx, userID), c.DisplayName, pet.Name, won, tier.Name),
+		map[string]interface{}{"chest": chestID, "opening_id": o.ID, "tier": tier.Name, "drop": drop, "duplicate": o.Duplicate, "coins": o.Coins})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// chestFromPath resolves the {chest} path value, writing a 404 if it is unknown.
+func chestFromPath(w http.ResponseWriter, r *http.Request) (string, chestType, bool) {
+	id := r.PathValue("chest")
+	c, ok := chestTypes[id]
+	if !ok {
+		http.Error(w, "Unknown chest", http.StatusNotFound)
+	}
+	return id, c, ok
+}
+
+// listChestsHandler returns every chest with its price, odds and pity rule, and for the
+// caller how many their pet holds and their pity counter.
+// Endpoint: GET /chests
+// Response:
+// - 200 OK with the chests and the hash of the caller's committed seed.
+// - 401 Unauthorized if the user is not authenticated.
+func listChestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	owned := map[string]int{}
+	if petID, err := getUserPetID(userID); err == nil {
+		if owned, err = petChests(db, petID); err != nil {
+			http.Error(w, "Error reading chests", http.StatusInternalServerError)
+			return
+		}
+	}
+	seed, err := activeChestSeed(db, userID)
+	if err != nil {
+		logMessage("list_chests_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error reading chests", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]string, 0, len(chestTypes))
+	for id := range chestTypes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	chests := []map[string]interface{}{}
+	for _, id := range ids {
+		c := chestTypes[id]
+		total := 0
+		for _, t := range c.Tiers {
+			total += t.Weight
+		}
+		tiers := []map[string]interface{}{}
+		for _, t := range c.Tiers {
+			tiers = append(tiers, map[string]interface{}{
+				"tier":   t.Name,
+				"weight": t.Weight,
+				"chance": float64(t.Weight) / float64(total),
+				"drops":  t.Drops,
+			})
+		}
+		pity, err := chestPity(db, userID, id, c)
+		if err != nil {
+			http.Error(w, "Error reading chests", http.StatusInternalServerError)
+			return
+		}
+		chests = append(chests, map[string]interface{}{
+			"id":           id,
+			"display_name": c.DisplayName,
+			"price":        c.Price,
+			"pity_tier":    c.PityTier,
+			"pity_after":   c.PityAfter,
+			"tiers":        tiers,
+			"owned":        owned[id],
+			"pity":         pity,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"chests": chests,
+		"seed":   seed.public(),
+	})
+}
+
+// chestQuantityLabel describes a number of chests for feed messages, e.g. "2 × Basic Chest".
+func chestQuantityLabel(c chestType, quantity int) string {
+	if quantity == 1 {
+		return "a " + c.DisplayName
+	}
+	return fmt.Sprintf("%d × %s", quantity, c.DisplayName)
+}
+
+// buyChestTx buys chests for a pet, paid from the pet's money.
+// Parameters:
+// - tx: The transaction to run in.
+// - pet: The pet to buy for.
+// - userID: The ID of the owner buying.
+// - chestID: The chest id.
+// - quantity: How many to buy.
+// - now: The current time.
+// Returns:
+// - How many of the chest the pet now holds.
+// - The activity entry recorded for the purchase.
+// - A *careRefusal if the chests cannot be bought, or another error if a query fails.
+func buyChestTx(tx *sql.Tx, pet *petRecord, userID int, chestID string, quantity int, now time.Time) (int, *activityEntry, error) {
+	c, ok := chestTypes[chestID]
+	if !ok {
+		return 0, nil, &careRefusal{Status: http.StatusNotFound, Message: "Unknown chest"}
+	}
+	if !pet.isOwner(userID) {
+		return 0, nil, &careRefusal{Status: http.StatusForbidden, Message: "Only owners can buy chests for a pet"}
+	}
+	if pet.State == statePassedAway {
+		return 0, nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has passed away", pet.Name)}
+	}
+	cost := c.Price * quantity
+	if err := checkSpendingTx(tx, pet, userID, cost, now); err != nil {
+		return 0, nil, err
+	}
+	res, err := tx.Exec("UPDATE pets SET money = money - ? WHERE id = ? AND money >= ?", cost, pet.ID, cost)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, nil, &careRefusal{Status: http.StatusPaymentRequired, Message: fmt.Sprintf("Insufficient funds: %s costs %d coins", chestQuantityLabel(c, quantity), cost)}
+	}
+	if _, err := recordTransaction(tx, pet.ID, userID, -cost, txReasonChestPurchase, chestID); err != nil {
+		return 0, nil, err
+	}
+	if err := grantChestsTx(tx, pet.ID, chestID, quantity); err != nil {
+		return 0, nil, err
+	}
+	owned, err := petChests(tx, pet.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	entry, err := recordActivity(tx, pet.ID, userID, activityChestBought,
+		fmt.Sprintf("%s bought %s for %s", userDisplayName(tx, userID), chestQuantityLabel(c, quantity), pet.Name),
+		map[string]interface{}{"chest": chestID, "quantity": quantity, "cost": cost})
+	if err != nil {
+		return 0, nil, err
+	}
+	return owned[chestID], entry, nil
+}
+
+// buyChestHandler buys chests for the caller's pet with the pet's money.
+// Endpoint: POST /chests/{chest}/buy
+// Request Body:
+// - quantity: Optional. How many to buy; defaults to 1.
+// Response:
+// - 200 OK with how many of the chest the pet now holds and the updated pet.
+// - 202 Accepted with a pending spending request if the purchase needs the main owner's approval.
+// - 400 Bad Request if the quantity is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 402 Payment Required if the pet cannot afford the chests.
+// - 403 Forbidden if the purchase would go over the caller's spending limit.
+// - 404 Not Found if the chest is unknown or the caller has no pet.
+// - 409 Conflict if the pet has passed away.
+func buyChestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	chestID, c, ok := chestFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 1 || req.Quantity > maxChestsPerPurchase {
+		http.Error(w, fmt.Sprintf("quantity must be between 1 and %d", maxChestsPerPurchase), http.StatusBadRequest)
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Caller has no pet", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error buying chest", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	owned, entry, err := buyChestTx(tx, pet, userID, chestID, req.Quantity, time.Now())
+	if err != nil {
+		var needsApproval *approvalRequired
+		if errors.As(err, &needsApproval) {
+			tx.Rollback()
+			writeApprovalRequested(w, pet, userID, spendingKindChest, chestID, req.Quantity, needsApproval.Cost, chestQuantityLabel(c, req.Quantity))
+			return
+		}
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			http.Error(w, refusal.Message, refusal.Status)
+			return
+		}
+		logMessage("buy_chest_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error buying chest", http.StatusInternalServerError)
+		return
+	}
+	if pet, err = loadPet(tx, petID); err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error buying chest", http.StatusInternalServerError)
+		return
+	}
+	publishPetStats(pet)
+	publishActivity(entry)
+
+	logMessage("buy_chest", map[string]interface{}{"pet_id": petID, "user_id": userID, "chest": chestID, "quantity": req.Quantity})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"chest": chestID,
+		"owned": owned,
+		"pet":   petData(pet),
+	})
+}
+
+// openChestHandler opens one of the caller's pet's chests.
+// Endpoint: POST /chests/{chest}/open
+// Request Body:
+// - client_seed: Optional. Mixed into the roll so the server cannot choose the outcome alone.
+// Response:
+// - 200 OK with the opening and the updated pet.
+// - 400 Bad Request if the client seed is too long.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if the chest is unknown or the caller has no pet.
+// - 409 Conflict if the pet has none of the chest or has passed away.
+func openChestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	chestID, _, ok := chestFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ClientSeed string `json:"client_seed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.ClientSeed) > maxClientSeedLength {
+		http.Error(w, fmt.Sprintf("client_seed must be at most %d characters", maxClientSeedLength), http.StatusBadRequest)
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Caller has no pet", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error opening chest", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if pet.State == statePassedAway {
+		http.Error(w, fmt.Sprintf("%s has passed away", pet.Name), http.StatusConflict)
+		return
+	}
+	result, err := openChestTx(tx, pet, userID, chestID, req.ClientSeed, time.Now())
+	if err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			http.Error(w, refusal.Message, refusal.Status)
+			return
+		}
+		logMessage("open_chest_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "chest": chestID})
+		http.Error(w, "Error opening chest", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error opening chest", http.StatusInternalServerError)
+		return
+	}
+	o := result.Opening
+	if o.Coins > 0 {
+		publishPetStats(result.Pet)
+	}
+	if o.Drop.Kind == dropItem && !o.Duplicate {
+		publishInventory(result.Pet, o.Drop.ID, result.ItemTotal)
+	}
+	publishActivity(result.Entry)
+
+	logMessage("open_chest", map[string]interface{}{"pet_id": petID, "user_id": userID, "chest": chestID, "opening_id": o.ID, "tier": o.Tier})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"opening": o,
+		"pet":     petData(result.Pet),
+	})
+}
+
+// chestSeedHandler returns the hash and nonce of the caller's committed seed.
+// Endpoint: GET /chests/seed
+// Response:
+// - 200 OK with the seed.
+// - 401 Unauthorized if the user is not authenticated.
+func chestSeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	seed, err := activeChestSeed(db, userID)
+	if err != nil {
+		logMessage("chest_seed_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error reading seed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, seed.public())
+}
+
+// rotateChestSeedHandler reveals the caller's current server seed, so the openings rolled
+// with it can be checked, and commits a new one.
+// Endpoint: POST /chests/seed/rotate
+// Response:
+// - 200 OK with the revealed seed as "previous" and the new commitment as "current".
+// - 401 Unauthorized if the user is not authenticated.
+func rotateChestSeedHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error rotating seed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	previous, err := activeChestSeed(tx, userID)
+	if err != nil {
+		http.Error(w, "Error rotating seed", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE chest_seeds SET revealed_at = ? WHERE id = ?", now, previous.ID); err != nil {
+		logMessage("chest_seed_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error rotating seed", http.StatusInternalServerError)
+		return
+	}
+	previous.RevealedAt = &now
+	current, err := activeChestSeed(tx, userID)
+	if err != nil {
+		http.Error(w, "Error rotating seed", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error rotating seed", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("chest_seed_rotated", map[string]interface{}{"user_id": userID, "seed_hash": previous.SeedHash})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"previous": previous.public(),
+		"current":  current.public(),
+	})
+}
+
+// chestOpeningsHandler returns a page of the caller's chest openings, newest first.
+// Openings rolled with a revealed seed include the server seed, so they can be re-rolled.
+// Endpoint: GET /chests/openings?limit=<n>&offset=<n>
+// Response:
+// - 200 OK with the openings.
+// - 401 Unauthorized if the user is not authenticated.
+func chestOpeningsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := parsePagination(r)
+	rows, err := db.Query(`SELECT o.id, o.chest_id, o.pet_id, s.seed_hash, s.server_seed, s.revealed_at, o.client_seed, o.nonce, o.pity,
+		o.tier, o.drop_kind, o.drop_id, o.amount, o.duplicate, o.coins, o.created_at
+		FROM chest_openings o JOIN chest_seeds s ON s.id = o.seed_id
+		WHERE o.user_id = ? ORDER BY o.id DESC LIMIT ? OFFSET ?`, userID, limit+1, offset)
+	if err != nil {
+		logMessage("chest_openings_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error reading openings", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []chestOpening{}
+	for rows.Next() {
+		var o chestOpening
+		var serverSeed string
+		var revealedAt sql.NullTime
+		var dropID sql.NullString
+		if err := rows.Scan(&o.ID, &o.ChestID, &o.PetID, &o.SeedHash, &serverSeed, &revealedAt, &o.ClientSeed, &o.Nonce, &o.Pity,
+			&o.Tier, &o.Drop.Kind, &dropID, &o.Drop.Amount, &o.Duplicate, &o.Coins, &o.CreatedAt); err != nil {
+			http.Error(w, "Error reading openings", http.StatusInternalServerError)
+			return
+		}
+		o.Drop.ID = dropID.String
+		if revealedAt.Valid {
+			o.ServerSeed = serverSeed
+		}
+		items = append(items, o)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading openings", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    items,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Stat bounds enforced by the CHECK constraints on the pets table.
+const (
+	minStat = 1
+	maxStat = 100
+)
+
+// decayConfig holds the tunables of the stat decay engine. Rates are points lost per
+// step and may be fractional; the species' *_decay multipliers scale them per pet.
+type decayConfig struct {
+	Interval time.Duration // length of one decay step
+
+	HungerRate    float64 // hunger lost per step
+	HappinessRate float64 // happiness lost per step
+	HealthRate    float64 // health lost per step regardless of other stats
+
+	StarvingThreshold   int     // hunger below this drains health
+	StarvingHealthDrain float64 // extra health lost per step while starving
+	SickThreshold       int     // health below this drains happiness
+	SickHappinessDrain  float64 // extra happiness lost per step while sick
+
+	SleepFactor float64 // multiplier applied to every rate while the pet is asleep
+}
+
+// decay is the active decay configuration, loaded from the environment by loadDecayConfig.
+var decay = decayConfig{
+	Interval:            10 * time.Minute,
+	HungerRate:          1,
+	HappinessRate:       1,
+	HealthRate:          0,
+	StarvingThreshold:   20,
+	StarvingHealthDrain: 2,
+	SickThreshold:       30,
+	SickHappinessDrain:  1,
+	SleepFactor:         0.5,
+}
+
+// loadDecayConfig overrides the default decay tunables with any DECAY_* environment
+// variables that are set. Invalid values are logged and ignored.
+func loadDecayConfig() {
+	if v := os.Getenv("DECAY_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			decay.Interval = d
+		} else {
+			logMessage("decay_config_invalid", map[string]interface{}{"name": "DECAY_INTERVAL", "value": v})
+		}
+	}
+	floats := map[string]*float64{
+		"DECAY_HUNGER_RATE":           &decay.HungerRate,
+		"DECAY_HAPPINESS_RATE":        &decay.HappinessRate,
+		"DECAY_HEALTH_RATE":           &decay.HealthRate,
+		"DECAY_STARVING_HEALTH_DRAIN": &decay.StarvingHealthDrain,
+		"DECAY_SICK_HAPPINESS_DRAIN":  &decay.SickHappinessDrain,
+		"DECAY_SLEEP_FACTOR":          &decay.SleepFactor,
+	}
+	for name, dst := range floats {
+		if v := os.Getenv(name); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+				*dst = f
+			} else {
+				logMessage("decay_config_invalid", map[string]interface{}{"name": name, "value": v})
+			}
+		}
+	}
+	ints := map[string]*int{
+		"DECAY_STARVING_THRESHOLD": &decay.StarvingThreshold,
+		"DECAY_SICK_THRESHOLD":     &decay.SickThreshold,
+	}
+	for name, dst := range ints {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n >= minStat && n <= maxStat {
+				*dst = n
+			} else {
+				logMessage("decay_config_invalid", map[string]interface{}{"name": name, "value": v})
+			}
+		}
+	}
+}
+
+// clampStat keeps a stat within the range allowed by the schema.
+func clampStat(v int) int {
+	if v < minStat {
+		return minStat
+	}
+	if v > maxStat {
+		return maxStat
+	}
+	return v
+}
+
+// stepLoss returns how many whole points a fractional per-step rate removes on the given
+// step. Summed over steps 1..n it equals floor(n*rate), so fractions are never lost
+// between steps and no extra state is needed to carry them.
+// Parameters:
+// - rate: Points lost per step.
+// - step: The 1-based index of the step.
+// Returns:
+// - The points lost on this step.
+func stepLoss(rate float64, step int64) int {
+	if rate <= 0 {
+		return 0
+	}
+	return int(math.Floor(float64(step)*rate) - math.Floor(float64(step-1)*rate))
+}
+
+// speciesDecayRates returns a species' decay multipliers. Unknown species decay at the base rate.
+// Parameters:
+// - q: The database or transaction to read from.
+// - species: The species id.
+// Returns:
+// - The hunger, happiness and health multipliers.
+// - An error if the query fails.
+func speciesDecayRates(q sqlExecutor, species string) (float64, float64, float64, error) {
+	var hunger, happiness, health float64
+	err := q.QueryRow("SELECT hunger_decay, happiness_decay, health_decay FROM species WHERE id = ?", species).
+		Scan(&hunger, &happiness, &health)
+	if err == sql.ErrNoRows {
+		return 1, 1, 1, nil
+	}
+	return hunger, happiness, health, err
+}
+
+// decayPetTx brings a pet's stats up to date by applying every whole decay step that has
+// elapsed since its last_updated timestamp. The timestamp advances by whole steps only,
+// so partial steps carry over to the next call. Steps that start while the pet is asleep
+// decay at decay.SleepFactor times the usual rates; steps that start during a vacation
+// do not decay at all.
+// Parameters:
+// - tx: The transaction to run in.
+// - petID: The ID of the pet.
+// - now: The current time.
+// Returns:
+// - The up-to-date pet.
+// - A boolean indicating if any stat changed.
+// - sql.ErrNoRows if the pet does not exist, or another error if a query fails.
+func decayPetTx(tx *sql.Tx, petID int, now time.Time) (*petRecord, bool, error) {
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		return nil, false, err
+	}
+	if pet.State == statePassedAway {
+		return pet, false, nil
+	}
+	if pet.Vacation, err = activeVacation(tx, petID, now); err != nil {
+		return nil, false, err
+	}
+
+	var lastUpdated sql.NullTime
+	var steps int64
+	if err := tx.QueryRow("SELECT last_updated, decay_steps FROM pets WHERE id = ?", petID).Scan(&lastUpdated, &steps); err != nil {
+		return nil, false, err
+	}
+	now = now.UTC()
+	if !lastUpdated.Valid {
+		// Pets created before the decay engine start decaying from now.
+		if _, err := tx.Exec("UPDATE pets SET last_updated = ? WHERE id = ?", now, petID); err != nil {
+			return nil, false, err
+		}
+		return pet, false, nil
+	}
+
+	elapsed := int64(now.Sub(lastUpdated.Time) / decay.Interval)
+	if elapsed <= 0 {
+		return pet, false, nil
+	}
+
+	hungerMul, happinessMul, healthMul, err := speciesDecayRates(tx, pet.Species)
+	if err != nil {
+		return nil, false, err
+	}
+	schedules, err := ownerSchedules(tx, pet)
+	if err != nil {
+		return nil, false, err
+	}
+	vacations, err := vacationsBetween(tx, petID, lastUpdated.Time, now)
+	if err != nil {
+		return nil, false, err
+	}
+	hunger, happiness, health := pet.Hunger, pet.Happiness, pet.Health
+	for i := int64(1); i <= elapsed; i++ {
+		step := steps + i
+		start := lastUpdated.Time.Add(time.Duration(i-1) * decay.Interval)
+		if onVacation(vacations, start) {
+			continue
+		}
+		// Interactions look at the stats as they were at the start of the step.
+		starving := hunger < decay.StarvingThreshold
+		sick := health < decay.SickThreshold
+		factor := 1.0
+		if asleepAt(schedules, start) {
+			factor = decay.SleepFactor
+		}
+
+		hunger -= stepLoss(decay.HungerRate*hungerMul*factor, step)
+		happiness -= stepLoss(decay.HappinessRate*happinessMul*factor, step)
+		health -= stepLoss(decay.HealthRate*healthMul*factor, step)
+		if starving {
+			health -= stepLoss(decay.StarvingHealthDrain*factor, step)
+		}
+		if sick {
+			happiness -= stepLoss(decay.SickHappinessDrain*factor, step)
+		}
+		hunger, happiness, health = clampStat(hunger), clampStat(happiness), clampStat(health)
+		if hunger == minStat && happiness == minStat && health == minStat {
+			// Nothing can fall any further; skip the remaining steps.
+			break
+		}
+	}
+
+	changed := hunger != pet.Hunger || happiness != pet.Happiness || health != pet.Health
+	newLastUpdated := lastUpdated.Time.Add(time.Duration(elapsed) * decay.Interval)
+	if _, err := tx.Exec("UPDATE pets SET hunger = ?, happiness = ?, health = ?, last_updated = ?, decay_steps = ? WHERE id = ?",
+		hunger, happiness, health, newLastUpdated, steps+elapsed, petID); err != nil {
+		return nil, false, err
+	}
+	pet.Hunger, pet.Happiness, pet.Health = hunger, happiness, health
+	return pet, changed, nil
+}
+
+// refreshPet applies any pending decay to a pet in its own transaction, moves it through
+// its lifecycle unless it is on vacation, updates its mood, and notifies the connected
+// owners of whatever changed.
+// Parameters:
+// - petID: The ID of the pet.
+// Returns:
+// - The up-to-date pet.
+// - sql.ErrNoRows if the pet does not exist, or another error if the update fails.
+func refreshPet(petID int) (*petRecord, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	pet, changed, err := decayPetTx(tx, petID, now)
+	if err != nil {
+		return nil, err
+	}
+	previous := pet.State
+	var entry *activityEntry
+	if state := nextState(pet, now); pet.Vacation == nil && state != pet.State {
+		if entry, err = setPetStateTx(tx, pet, state, 0, now); err != nil {
+			return nil, err
+		}
+	}
+	previousMood, moodChanged, err := updateMoodTx(tx, pet, now)
+	if err != nil {
+		return nil, err
+	}
+	due := changed || entry != nil
+	if !due {
+		if due, err = sampleDue(tx, pet.ID, now); err != nil {
+			return nil, err
+		}
+	}
+	if due {
+		if err := recordStatSample(tx, pet, now); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	// These changes are server-initiated, so owners in their quiet hours are not disturbed.
+	if changed {
+		if err := recordLeaderboardScore(db, "happiness", pet.ID, pet.Happiness); err != nil {
+			logMessage("decay_leaderboard_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		}
+		notifyOwners(pet, petStatsMessage(pet))
+	}
+	if entry != nil {
+		logMessage("pet_state_changed", map[string]interface{}{"pet_id": pet.ID, "state": pet.State, "previous_state": previous})
+		notifyOwners(pet, activityMessage(entry))
+		notifyOwners(pet, petStateMessage(pet, previous))
+	}
+	if moodChanged {
+		notifyOwners(pet, moodMessage(pet, previousMood))
+	}
+	return pet, nil
+}
+
+// petStatsMessage builds the PetStatsUpdate message for a pet.
+func petStatsMessage(p *petRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "PetStatsUpdate",
+		"pet_id":    p.ID,
+		"health":    p.Health,
+		"hunger":    p.Hunger,
+		"happiness": p.Happiness,
+		"money":     p.Money,
+	}
+}
+
+// publishPetStats pushes a pet's current stats to every connected owner.
+// Parameters:
+// - p: The pet whose stats changed.
+func publishPetStats(p *petRecord) {
+	sendToOwners(p, petStatsMessage(p))
+}
+
+// runDecayTicker advances every pet's stats once per decay interval until the process exits.
+func runDecayTicker() {
+	ticker := time.NewTicker(decay.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		decayAllPets()
+	}
+}
+
+// decayAllPets applies pending decay to every pet that is still alive.
+func decayAllPets() {
+	rows, err := db.Query("SELECT id FROM pets WHERE state != ?", statePassedAway)
+	if err != nil {
+		logMessage("decay_error", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	var petIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			petIDs = append(petIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, petID := range petIDs {
+		if _, err := refreshPet(petID); err != nil {
+			logMessage("decay_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		}
+	}
+}
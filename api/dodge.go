@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DodgeFall constants, mirroring src/Pages/Game.tsx. The client animates once per frame;
+// the replay runs at a fixed 60 ticks per second, so clients submitting replays must step
+// their simulation the same way.
+const (
+	dodgeWidth           = 500
+	dodgeHeight          = 600
+	dodgePlayerSize      = 30
+	dodgePlayerStep      = 15
+	dodgeProjectileSize  = 15
+	dodgeProjectileSpeed = 5 // pixels per tick
+	dodgeTickRate        = 60
+	dodgeSpawnEvery      = 18 // ticks between projectiles (300 ms)
+	dodgeTicks           = 15 * dodgeTickRate
+	dodgeMaxInputs       = dodgeTicks // one input per tick at most
+)
+
+// Moves accepted in a DodgeFall input log.
+const (
+	dodgeMoveLeft  = "left"
+	dodgeMoveRight = "right"
+)
+
+// minigameInput is one entry of a replay input log: a key press applied at the start of a tick.
+type minigameInput struct {
+	Tick int    `json:"tick"`
+	Move string `json:"move"`
+}
+
+// mulberry32 is the seeded generator shared by the server and the client. It is small
+// enough to port exactly to JavaScript:
+//
+//	a = a + 0x6D2B79F5 | 0; t = Math.imul(a ^ a >>> 15, a | 1);
+//	t = (t + Math.imul(t ^ t >>> 7, t | 61)) ^ t; return ((t ^ t >>> 14) >>> 0) / 4294967296;
+type mulberry32 uint32
+
+// next returns the next value in [0, 1).
+func (s *mulberry32) next() float64 {
+	*s += 0x6D2B79F5
+	a := uint32(*s)
+	t := (a ^ a>>15) * (a | 1)
+	t = (t + (t^t>>7)*(t|61)) ^ t
+	return float64(t^t>>14) / 4294967296
+}
+
+// dodgePoint is the top-left corner of the player or a projectile.
+type dodgePoint struct {
+	X, Y float64
+}
+
+// replayDodge re-runs a round of DodgeFall from its seed and the player's inputs. Each tick
+// applies that tick's input, spawns a projectile every dodgeSpawnEvery ticks, moves the
+// projectiles, and then checks for a hit, in the same order as the client.
+// Parameters:
+// - seed: The session's seed.
+// - inputs: The input log, in tick order, with at most one input per tick and ticks from 1 to dodgeTicks.
+// Returns:
+// - The score: whole seconds survived.
+// - How long the round lasted.
+// - An error if the input log is malformed.
+func replayDodge(seed int64, inputs []minigameInput) (int, time.Duration, error) {
+	if len(inputs) > dodgeMaxInputs {
+		return 0, 0, fmt.Errorf("at most %d inputs are accepted", dodgeMaxInputs)
+	}
+	for i, in := range inputs {
+		if in.Tick < 1 || in.Tick > dodgeTicks {
+			return 0, 0, fmt.Errorf("input %d: tick must be between 1 and %d", i, dodgeTicks)
+		}
+		if i > 0 && in.Tick <= inputs[i-1].Tick {
+			return 0, 0, fmt.Errorf("input %d: ticks must increase, with at most one input per tick", i)
+		}
+		if in.Move != dodgeMoveLeft && in.Move != dodgeMoveRight {
+			return 0, 0, fmt.Errorf("input %d: move must be left or right", i)
+		}
+	}
+
+	rng := mulberry32(uint32(seed))
+	player := dodgePoint{X: dodgeWidth/2 - dodgePlayerSize/2, Y: dodgeHeight - dodgePlayerSize - 10}
+	var projectiles []dodgePoint
+	next := 0
+	for tick := 1; tick <= dodgeTicks; tick++ {
+		if next < len(inputs) && inputs[next].Tick == tick {
+			if inputs[next].Move == dodgeMoveLeft {
+				player.X = max(0, player.X-dodgePlayerStep)
+			} else {
+				player.X = min(dodgeWidth-dodgePlayerSize, player.X+dodgePlayerStep)
+			}
+			next++
+		}
+		if tick%dodgeSpawnEvery == 0 {
+			projectiles = append(projectiles, dodgePoint{X: rng.next() * (dodgeWidth - dodgeProjectileSize), Y: -dodgeProjectileSize})
+		}
+		kept := projectiles[:0]
+		for _, p := range projectiles {
+			p.Y += dodgeProjectileSpeed
+			if p.Y < dodgeHeight {
+				kept = append(kept, p)
+			}
+		}
+		projectiles = kept
+		for _, p := range projectiles {
+			if player.X < p.X+dodgeProjectileSize && player.X+dodgePlayerSize > p.X &&
+				player.Y < p.Y+dodgeProjectileSize && player.Y+dodgePlayerSize > p.Y {
+				return tick / dodgeTickRate, dodgeTickDuration(tick), nil
+			}
+		}
+	}
+	return dodgeTicks / dodgeTickRate, dodgeTickDuration(dodgeTicks), nil
+}
+
+// dodgeTickDuration returns how long the given number of ticks lasts.
+func dodgeTickDuration(ticks int) time.Duration {
+	return time.Duration(ticks) * time.Second / dodgeTickRate
+}
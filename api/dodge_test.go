@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMulberry32MatchesClient checks the generator against outputs of the JavaScript
+// mulberry32 in api.txt, including a seed above the int32 range.
+func TestMulberry32MatchesClient(t *testing.T) {
+	tests := []struct {
+		seed uint32
+		want []float64
+	}{
+		{42, []float64{0.6011037519201636, 0.44829055899754167, 0.8524657934904099, 0.6697340414393693, 0.17481389874592423}},
+		{3000000000, []float64{0.7568875285796821, 0.3733226382173598, 0.9749945921357721, 0.3353162407875061, 0.43787257629446685}},
+	}
+	for _, tt := range tests {
+		rng := mulberry32(tt.seed)
+		for i, want := range tt.want {
+			if got := rng.next(); got != want {
+				t.Errorf("seed %d, output %d = %v, want %v", tt.seed, i, got, want)
+			}
+		}
+	}
+}
+
+// zigzagInputs is an input log that presses a key every 10 ticks, moving right for 40 ticks
+// and then left for 40, for the whole round.
+func zigzagInputs() []minigameInput {
+	var inputs []minigameInput
+	for tick := 10; tick <= dodgeTicks; tick += 10 {
+		move := dodgeMoveRight
+		if tick/40%2 == 1 {
+			move = dodgeMoveLeft
+		}
+		inputs = append(inputs, minigameInput{Tick: tick, Move: move})
+	}
+	return inputs
+}
+
+// TestReplayDodgeMatchesClient replays rounds whose collision ticks were computed by running
+// the same seed and inputs through a JavaScript port of the Game.tsx loop.
+func TestReplayDodgeMatchesClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		seed     int64
+		inputs   []minigameInput
+		hitTick  int
+		wantSecs int
+	}{
+		{"standing still", 1234567, nil, 292, 4},
+		{"zigzag", 1234567, zigzagInputs(), 364, 6}, // inputs after the hit are ignored
+		{"other seed", 7, nil, 202, 3},
+	}
+	for _, tt := range tests {
+		score, duration, err := replayDodge(tt.seed, tt.inputs)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if score != tt.wantSecs || duration != time.Duration(tt.hitTick)*time.Second/dodgeTickRate {
+			t.Errorf("%s: scored %d after %v, want %d after tick %d", tt.name, score, duration, tt.wantSecs, tt.hitTick)
+		}
+	}
+}
+
+// TestReplayDodgeRejectsMalformedLogs checks the input log rules, including at most one
+// input per tick.
+func TestReplayDodgeRejectsMalformedLogs(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []minigameInput
+		want   string
+	}{
+		{"two inputs on one tick", []minigameInput{{Tick: 5, Move: dodgeMoveLeft}, {Tick: 5, Move: dodgeMoveRight}}, "at most one input per tick"},
+		{"ticks going back", []minigameInput{{Tick: 6, Move: dodgeMoveLeft}, {Tick: 5, Move: dodgeMoveRight}}, "ticks must increase"},
+		{"tick out of range", []minigameInput{{Tick: dodgeTicks + 1, Move: dodgeMoveLeft}}, "tick must be between"},
+		{"unknown move", []minigameInput{{Tick: 1, Move: "up"}}, "move must be left or right"},
+	}
+	for _, tt := range tests {
+		_, _, err := replayDodge(1, tt.inputs)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Typed economy operations sent over /ws as the message type. Clients name what they are
+// doing; the server decides what it costs or pays. Adoption is POST /create_pet, since a
+// user without a pet cannot open a WebSocket.
+const (
+	opPurchase    = "purchase"
+	opGift        = "gift"
+	opReward      = "reward"
+	opClaimStreak = "claimstreak"
+)
+
+const (
+	// maxGiftAmount bounds a single Gift.
+	maxGiftAmount = 50
+	// maxGiftCoinsPerDay bounds the coins one user can give away per UTC day.
+	maxGiftCoinsPerDay = 100
+)
+
+// rewardSource is a server-defined payout that a user can claim once per UTC day.
+type rewardSource struct {
+	Coins int
+	Label string // used in messages, e.g. "the daily reward"
+}
+
+// rewardSources are the payouts available to Reward, keyed by source.
+var rewardSources = map[string]rewardSource{
+	"daily": {Coins: 10, Label: "the daily reward"},
+}
+
+// legacyMoneyUpdates keeps the raw PetMoneyUpdate message working for old clients.
+// Set LEGACY_MONEY_UPDATES=true to enable it.
+var legacyMoneyUpdates = false
+
+// loadEconomyConfig reads LEGACY_MONEY_UPDATES from the environment if it is set.
+func loadEconomyConfig() {
+	if v := os.Getenv("LEGACY_MONEY_UPDATES"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			legacyMoneyUpdates = b
+		} else {
+			logMessage("economy_config_invalid", map[string]interface{}{"name": "LEGACY_MONEY_UPDATES", "value": v})
+		}
+	}
+}
+
+// economyFail replies to a Purchase, Gift or Reward message with a failure.
+func economyFail(conn *websocket.Conn, responseType, message string) {
+	writeConn(conn, map[string]interface{}{
+		"type":    responseType,
+		"status":  "fail",
+		"message": message,
+	})
+}
+
+// startOfDay returns midnight UTC of the day t falls in.
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// handlePurchase buys items into the caller's pet's inventory at the price in the items
+// table. The caller receives a PurchaseResponse; every owner receives the new stats and an
+// InventoryUpdate. A co-owner's purchase over the pet's approval threshold is answered with
+// status "pending" and sent to the main owner instead.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - message: The raw message, which must name an "item", may give a "quantity" and must carry an "idempotency_key".
+func handlePurchase(conn *websocket.Conn, userID int, message []byte) {
+	const responseType = "PurchaseResponse"
+	var req struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+	}
+	_ = json.Unmarshal(message, &req)
+	key := idempotencyKey(message)
+	if key == "" {
+		economyFail(conn, responseType, "idempotency_key is required")
+		return
+	}
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	item, err := loadItem(db, req.Item)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, fmt.Sprintf("Unknown item %q", req.Item))
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, "Caller has no pet")
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	defer tx.Rollback()
+
+	// The write lock is taken at Begin, so a message with the same key that was still
+	// running when this one was checked above has committed by now.
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	owned, entry, err := buyItemTx(tx, pet, userID, item, req.Quantity, time.Now())
+	if err != nil {
+		var needsApproval *approvalRequired
+		if errors.As(err, &needsApproval) {
+			tx.Rollback()
+			request, err := requestApproval(pet, userID, spendingKindItem, item.ID, req.Quantity, needsApproval.Cost, itemQuantityLabel(item, req.Quantity))
+			if err != nil {
+				logMessage("purchase_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+				economyFail(conn, responseType, "Server error occurred")
+				return
+			}
+			writeConn(conn, map[string]interface{}{
+				"type":    responseType,
+				"status":  "pending",
+				"message": needsApproval.Error(),
+				"request": request,
+			})
+			return
+		}
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			economyFail(conn, responseType, refusal.Message)
+			return
+		}
+		logMessage("purchase_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "item": item.ID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if pet, err = loadPet(tx, petID); err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	response := map[string]interface{}{
+		"type":     responseType,
+		"status":   "success",
+		"item":     item.ID,
+		"quantity": owned,
+		"newMoney": pet.Money,
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, response); err != nil {
+		tx.Rollback()
+		if err == errDuplicateRequest {
+			replayIdempotentResponse(conn, userID, key)
+			return
+		}
+		logMessage("purchase_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	writeConn(conn, response)
+	logMessage("purchase", map[string]interface{}{"user_id": userID, "pet_id": petID, "item": item.ID, "quantity": req.Quantity})
+	publishPetStats(pet)
+	publishInventory(pet, item.ID, owned)
+	publishActivity(entry)
+}
+
+// handleGift moves coins from the caller's pet to a friend's pet. Both sides are recorded in
+// the ledger, and the transfer is capped per gift and per sender per UTC day.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - message: The raw message, which must name the "user" (a username) and a positive "amount", and carry an "idempotency_key".
+func handleGift(conn *websocket.Conn, userID int, message []byte) {
+	const responseType = "GiftResponse"
+	var req struct {
+		User   string `json:"user"`
+		Amount int    `json:"amount"`
+	}
+	if err := json.Unmarshal(message, &req); err != nil {
+		economyFail(conn, responseType, "Invalid message")
+		return
+	}
+	key := idempotencyKey(message)
+	if key == "" {
+		economyFail(conn, responseType, "idempotency_key is required")
+		return
+	}
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+	if req.Amount < 1 || req.Amount > maxGiftAmount {
+		economyFail(conn, responseType, fmt.Sprintf("amount must be between 1 and %d", maxGiftAmount))
+		return
+	}
+
+	recipientID, err := lookupUserID(req.User)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, "User not found")
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	friends, err := areFriends(userID, recipientID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	blocked, err := isBlockedBetween(userID, recipientID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if !friends || blocked {
+		economyFail(conn, responseType, "Gifts can only be sent to friends")
+		return
+	}
+	fromPetID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, "Caller has no pet")
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	toPetID, err := getUserPetID(recipientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, fmt.Sprintf("%s has no pet", req.User))
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if fromPetID == toPetID {
+		economyFail(conn, responseType, "Gifts cannot be sent to your own pet")
+		return
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	defer tx.Rollback()
+
+	// The write lock is taken at Begin, so a message with the same key that was still
+	// running when this one was checked above has committed by now.
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+
+	// The write lock is held from Begin, so the day's total cannot change under us.
+	var givenToday int
+	err = tx.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM transactions WHERE user_id = ? AND reason = ? AND created_at >= ?",
+		userID, txReasonGiftSent, startOfDay(now)).Scan(&givenToday)
+	if err != nil {
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if givenToday+req.Amount > maxGiftCoinsPerDay {
+		economyFail(conn, responseType, fmt.Sprintf("You can give away %d more coins today", max(0, maxGiftCoinsPerDay-givenToday)))
+		return
+	}
+
+	fromPet, err := loadPet(tx, fromPetID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := checkSpendingTx(tx, fromPet, userID, req.Amount, now); err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			economyFail(conn, responseType, refusal.Message)
+			return
+		}
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	var newMoney int
+	err = tx.QueryRow("UPDATE pets SET money = money - ? WHERE id = ? AND money >= ? RETURNING money", req.Amount, fromPetID, req.Amount).Scan(&newMoney)
+	if err == sql.ErrNoRows {
+		economyFail(conn, responseType, "Insufficient funds. Pet money cannot go below 0.")
+		return
+	}
+	if err != nil {
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "pet_id": fromPetID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if _, err := tx.Exec("UPDATE pets SET money = money + ? WHERE id = ?", req.Amount, toPetID); err != nil {
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "pet_id": toPetID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if _, err := recordTransaction(tx, fromPetID, userID, -req.Amount, txReasonGiftSent, strconv.Itoa(toPetID)); err != nil {
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "pet_id": fromPetID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if _, err := recordTransaction(tx, toPetID, userID, req.Amount, txReasonGiftReceived, strconv.Itoa(fromPetID)); err != nil {
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "pet_id": toPetID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	fromPet, err = loadPet(tx, fromPetID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	toPet, err := loadPet(tx, toPetID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	giver := userDisplayName(tx, userID)
+	sentEntry, err := recordActivity(tx, fromPetID, userID, activityGiftSent,
+		fmt.Sprintf("%s gave %d coins to %s", giver, req.Amount, toPet.Name),
+		map[string]interface{}{"amount": req.Amount, "to_pet_id": toPetID, "new_money": newMoney})
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	receivedEntry, err := recordActivity(tx, toPetID, userID, activityGiftReceived,
+		fmt.Sprintf("%s gave %s %d coins", giver, toPet.Name, req.Amount),
+		map[string]interface{}{"amount": req.Amount, "from_pet_id": fromPetID, "new_money": toPet.Money})
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	response := map[string]interface{}{
+		"type":     responseType,
+		"status":   "success",
+		"user":     req.User,
+		"amount":   req.Amount,
+		"newMoney": newMoney,
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, response); err != nil {
+		tx.Rollback()
+		if err == errDuplicateRequest {
+			replayIdempotentResponse(conn, userID, key)
+			return
+		}
+		logMessage("gift_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	writeConn(conn, response)
+	logMessage("gift", map[string]interface{}{"user_id": userID, "from_pet_id": fromPetID, "to_pet_id": toPetID, "amount": req.Amount})
+	sendToOwners(fromPet, petStatsMessage(fromPet))
+	sendToOwners(toPet, petStatsMessage(toPet))
+	publishActivity(sentEntry)
+	publishActivity(receivedEntry)
+}
+
+// handleReward pays a server-defined reward into the caller's pet. Each source can be
+// claimed once per user per UTC day; the ledger is the record of past claims.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - message: The raw message, which must name a "source" and carry an "idempotency_key".
+func handleReward(conn *websocket.Conn, userID int, message []byte) {
+	const responseType = "RewardResponse"
+	var req struct {
+		Source string `json:"source"`
+	}
+	_ = json.Unmarshal(message, &req)
+	key := idempotencyKey(message)
+	if key == "" {
+		economyFail(conn, responseType, "idempotency_key is required")
+		return
+	}
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+	source, ok := rewardSources[req.Source]
+	if !ok {
+		economyFail(conn, responseType, fmt.Sprintf("Unknown reward source %q", req.Source))
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, "Caller has no pet")
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	defer tx.Rollback()
+
+	// The write lock is taken at Begin, so a message with the same key that was still
+	// running when this one was checked above has committed by now.
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+
+	var claimed int
+	err = tx.QueryRow("SELECT COUNT(*) FROM transactions WHERE user_id = ? AND reason = ? AND reference = ? AND created_at >= ?",
+		userID, txReasonReward, req.Source, startOfDay(now)).Scan(&claimed)
+	if err != nil {
+		logMessage("reward_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if claimed > 0 {
+		economyFail(conn, responseType, fmt.Sprintf("You already claimed %s today", source.Label))
+		return
+	}
+
+	var newMoney int
+	if err := tx.QueryRow("UPDATE pets SET money = money + ? WHERE id = ? RETURNING money", source.Coins, petID).Scan(&newMoney); err != nil {
+		logMessage("reward_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if _, err := recordTransaction(tx, petID, userID, source.Coins, txReasonReward, req.Source); err != nil {
+		logMessage("reward_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := recordLeaderboardScore(tx, "coins_earned", petID, source.Coins); err != nil {
+		logMessage("reward_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	response := map[string]interface{}{
+		"type":     responseType,
+		"status":   "success",
+		"source":   req.Source,
+		"coins":    source.Coins,
+		"newMoney": newMoney,
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, response); err != nil {
+		tx.Rollback()
+		if err == errDuplicateRequest {
+			replayIdempotentResponse(conn, userID, key)
+			return
+		}
+		logMessage("reward_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	writeConn(conn, response)
+	logMessage("reward", map[string]interface{}{"user_id": userID, "pet_id": petID, "source": req.Source, "coins": source.Coins})
+	sendToOwners(pet, petStatsMessage(pet))
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// friendSummary describes another user in a friends list response.
+type friendSummary struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Since    time.Time `json:"since"`
+}
+
+// friendRequestSummary describes a pending friend request in either direction.
+type friendRequestSummary struct {
+	RequestID int       `json:"request_id"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// isBlockedBetween reports whether either user has blocked the other.
+// Parameters:
+// - a: The ID of the first user.
+// - b: The ID of the second user.
+// Returns:
+// - A boolean indicating if a block exists in either direction.
+// - An error if the query fails.
+func isBlockedBetween(a, b int) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM blocks WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", a, b, b, a).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// areFriends reports whether two users have an accepted friendship.
+// Parameters:
+// - a: The ID of the first user.
+// - b: The ID of the second user.
+// Returns:
+// - A boolean indicating if the users are friends.
+// - An error if the query fails.
+func areFriends(a, b int) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM friendships WHERE status = 'accepted' AND ((requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?))", a, b, b, a).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// friendIDs returns the IDs of all users with an accepted friendship with the user.
+// Parameters:
+// - userID: The ID of the user.
+// Returns:
+// - The friends' user IDs.
+// - An error if the query fails.
+func friendIDs(userID int) ([]int, error) {
+	rows, err := db.Query("SELECT CASE WHEN requester_id = ? THEN addressee_id ELSE requester_id END FROM friendships WHERE status = 'accepted' AND (requester_id = ? OR addressee_id = ?)", userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// userIDFromPath parses the {userID} path value of a route.
+// Returns:
+// - The user ID and true, or false after writing a 400 response.
+func userIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// listFriendsHandler returns the caller's friends and pending friend requests.
+// Endpoint: GET /friends
+// Response:
+// - 200 OK with "friends", "incoming" and "outgoing" lists.
+// - 401 Unauthorized if the user is not authenticated.
+// - 500 Internal Server Error if the lookup fails.
+func listFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`SELECT f.id, f.status, f.requester_id, f.created_at, f.responded_at, u.id, u.username
+		FROM friendships f
+		JOIN users u ON u.id = CASE WHEN f.requester_id = ? THEN f.addressee_id ELSE f.requester_id END
+		WHERE f.requester_id = ? OR f.addressee_id = ?
+		ORDER BY u.username`, userID, userID, userID)
+	if err != nil {
+		logMessage("list_friends_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error reading friends", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	friends := []friendSummary{}
+	incoming := []friendRequestSummary{}
+	outgoing := []friendRequestSummary{}
+	for rows.Next() {
+		var requestID, requesterID, otherID int
+		var status, username string
+		var createdAt time.Time
+		var respondedAt sql.NullTime
+		if err := rows.Scan(&requestID, &status, &requesterID, &createdAt, &respondedAt, &otherID, &username); err != nil {
+			logMessage("list_friends_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+			http.Error(w, "Error reading friends", http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case status == "accepted":
+			since := createdAt
+			if respondedAt.Valid {
+				since = respondedAt.Time
+			}
+			friends = append(friends, friendSummary{UserID: otherID, Username: username, Since: since})
+		case requesterID == userID:
+			outgoing = append(outgoing, friendRequestSummary{RequestID: requestID, UserID: otherID, Username: username, CreatedAt: createdAt})
+		default:
+			incoming = append(incoming, friendRequestSummary{RequestID: requestID, UserID: otherID, Username: username, CreatedAt: createdAt})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading friends", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"friends":  friends,
+		"incoming": incoming,
+		"outgoing": outgoing,
+	})
+}
+
+// sendFriendRequestHandler sends a friend request to another user.
+// If the target user already sent the caller a request, it is accepted instead.
+// Endpoint: POST /friends/requests
+// Request Body:
+// - username: The username of the user to befriend.
+// Response:
+// - 201 Created when a request is sent.
+// - 200 OK when an existing incoming request was accepted.
+// - 400 Bad Request if the body is invalid, the target is the caller, or they are already friends.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if either user has blocked the other.
+// - 404 Not Found if the target user does not exist.
+// - 409 Conflict if a request is already pending.
+func sendFriendRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	targetID, err := lookupUserID(req.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Target user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading target user", http.StatusInternalServerError)
+		return
+	}
+	if targetID == userID {
+		http.Error(w, "Cannot befriend yourself", http.StatusBadRequest)
+		return
+	}
+
+	blocked, err := isBlockedBetween(userID, targetID)
+	if err != nil {
+		http.Error(w, "Error checking blocks", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "Cannot send a friend request to this user", http.StatusForbidden)
+		return
+	}
+
+	var existingID, requesterID int
+	var status string
+	err = db.QueryRow("SELECT id, requester_id, status FROM friendships WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)", userID, targetID, targetID, userID).
+		Scan(&existingID, &requesterID, &status)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := db.Exec("INSERT INTO friendships (requester_id, addressee_id, status, created_at) VALUES (?, ?, 'pending', ?)", userID, targetID, time.Now().UTC()); err != nil {
+			logMessage("friend_request_error", map[string]interface{}{"error": err.Error(), "user_id": userID, "target_id": targetID})
+			http.Error(w, "Error sending friend request", http.StatusInternalServerError)
+			return
+		}
+		logMessage("friend_request_sent", map[string]interface{}{"user_id": userID, "target_id": targetID})
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Friend request sent"))
+	case err != nil:
+		http.Error(w, "Error reading friendships", http.StatusInternalServerError)
+	case status == "accepted":
+		http.Error(w, "Already friends", http.StatusBadRequest)
+	case requesterID == userID:
+		http.Error(w, "Friend request already pending", http.StatusConflict)
+	default:
+		// The target already asked the caller; treat this as accepting their request.
+		if _, err := db.Exec("UPDATE friendships SET status = 'accepted', responded_at = ? WHERE id = ?", time.Now().UTC(), existingID); err != nil {
+			http.Error(w, "Error accepting friend request", http.StatusInternalServerError)
+			return
+		}
+		logMessage("friend_request_accepted", map[string]interface{}{"user_id": userID, "request_id": existingID})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Friend request accepted"))
+	}
+}
+
+// respondFriendRequestHandler accepts or declines a pending friend request addressed to the caller.
+// Endpoint: POST /friends/requests/{id}/{action} where action is "accept" or "decline"
+// Response:
+// - 200 OK on success.
+// - 400 Bad Request if the id or action is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if no pending request with that id is addressed to the caller.
+func respondFriendRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	requestID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid request id", http.StatusBadRequest)
+		return
+	}
+
+	var res sql.Result
+	switch r.PathValue("action") {
+	case "accept":
+		res, err = db.Exec("UPDATE friendships SET status = 'accepted', responded_at = ? WHERE id = ? AND addressee_id = ? AND status = 'pending'", time.Now().UTC(), requestID, userID)
+	case "decline":
+		res, err = db.Exec("DELETE FROM friendships WHERE id = ? AND addressee_id = ? AND status = 'pending'", requestID, userID)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logMessage("friend_request_error", map[string]interface{}{"error": err.Error(), "user_id": userID, "request_id": requestID})
+		http.Error(w, "Error updating friend request", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Friend request not found", http.StatusNotFound)
+		return
+	}
+
+	logMessage("friend_request_"+r.PathValue("action"), map[string]interface{}{"user_id": userID, "request_id": requestID})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Friend request updated"))
+}
+
+// removeFriendHandler ends a friendship or withdraws a pending request with another user.
+// Endpoint: DELETE /friends/{userID}
+// Response:
+// - 200 OK on success.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if there is no friendship with that user.
+func removeFriendHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	otherID, ok := userIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM friendships WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)", userID, otherID, otherID, userID)
+	if err != nil {
+		http.Error(w, "Error removing friend", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Friendship not found", http.StatusNotFound)
+		return
+	}
+
+	logMessage("friend_removed", map[string]interface{}{"user_id": userID, "other_id": otherID})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Friend removed"))
+}
+
+// blockUserHandler blocks another user. Any friendship or pending request between the
+// two users is removed, and the blocked user can no longer send friend requests,
+// co-owner invitations, or visit the caller's pets.
+// Endpoint: POST /blocks
+// Request Body:
+// - username: The username of the user to block.
+// Response:
+// - 200 OK on success.
+// - 400 Bad Request if the body is invalid or the target is the caller.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if the target user does not exist.
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	targetID, err := lookupUserID(req.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Target user not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading target user", http.StatusInternalServerError)
+		return
+	}
+	if targetID == userID {
+		http.Error(w, "Cannot block yourself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO blocks (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)", userID, targetID, time.Now().UTC()); err != nil {
+		logMessage("block_user_error", map[string]interface{}{"error": err.Error(), "user_id": userID, "target_id": targetID})
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM friendships WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)", userID, targetID, targetID, userID); err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error blocking user", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("user_blocked", map[string]interface{}{"user_id": userID, "target_id": targetID})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("User blocked"))
+}
+
+// unblockUserHandler removes a block the caller placed on another user.
+// Endpoint: DELETE /blocks/{userID}
+// Response:
+// - 200 OK on success.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if the caller has not blocked that user.
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	targetID, ok := userIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", userID, targetID)
+	if err != nil {
+		http.Error(w, "Error unblocking user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+
+	logMessage("user_unblocked", map[string]interface{}{"user_id": userID, "target_id": targetID})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("User unblocked"))
+}
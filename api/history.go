@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Stat history resolutions. Raw samples are averaged into hourly buckets once they are
+// older than rawRetention, and hourly buckets into daily ones after hourlyRetention.
+const (
+	resolutionRaw  = "raw"
+	resolutionHour = "hour"
+	resolutionDay  = "day"
+)
+
+const (
+	// historySampleInterval is the longest a live pet goes without a history sample.
+	historySampleInterval = time.Hour
+	rawRetention          = 7 * 24 * time.Hour
+	hourlyRetention       = 30 * 24 * time.Hour
+	// maxHistoryRange and maxHistoryPoints bound a single GET /pets/{id}/history request.
+	maxHistoryRange  = 90 * 24 * time.Hour
+	maxHistoryPoints = 5000
+)
+
+// historyStats are the values sampled into pet_stat_history, and the accepted values of the
+// endpoint's stat parameter.
+var historyStats = map[string]bool{
+	"health":    true,
+	"hunger":    true,
+	"happiness": true,
+	"money":     true,
+	"xp":        true,
+}
+
+// recordStatSample appends a raw sample of a pet's current stats to its history.
+// Parameters:
+// - q: The database or transaction to write to.
+// - p: The pet to sample.
+// - now: The sample time.
+// Returns:
+// - An error if the insert fails.
+func recordStatSample(q sqlExecutor, p *petRecord, now time.Time) error {
+	_, err := q.Exec("INSERT INTO pet_stat_history (pet_id, recorded_at, resolution, health, hunger, happiness, money, xp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		p.ID, now.UTC(), resolutionRaw, p.Health, p.Hunger, p.Happiness, p.Money, p.XP)
+	return err
+}
+
+// sampleDue reports whether a pet has gone historySampleInterval without a sample.
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// - now: The current time.
+// Returns:
+// - A boolean indicating if a sample should be taken.
+// - An error if the query fails.
+func sampleDue(q sqlExecutor, petID int, now time.Time) (bool, error) {
+	var last time.Time
+	err := q.QueryRow("SELECT recorded_at FROM pet_stat_history WHERE pet_id = ? ORDER BY recorded_at DESC LIMIT 1", petID).Scan(&last)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return now.Sub(last) >= historySampleInterval, nil
+}
+
+// samplePet records a history sample for a pet outside of any transaction, logging failures.
+// Parameters:
+// - petID: The ID of the pet.
+func samplePet(petID int) {
+	pet, err := loadPet(db, petID)
+	if err == nil {
+		err = recordStatSample(db, pet, time.Now())
+	}
+	if err != nil {
+		logMessage("stat_history_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+	}
+}
+
+// historySample is one row of pet_stat_history.
+type historySample struct {
+	At        time.Time
+	Health    float64
+	Hunger    float64
+	Happiness float64
+	Money     float64
+	XP        float64
+}
+
+// downsampleHistory averages samples of one resolution that are older than the cutoff into
+// buckets of the next resolution, replacing them.
+// Parameters:
+// - from: The resolution to fold, resolutionRaw or resolutionHour.
+// - to: The resolution of the buckets.
+// - bucket: The bucket length.
+// - cutoff: Samples recorded before this time are folded.
+// Returns:
+// - An error if the rewrite fails.
+func downsampleHistory(from, to string, bucket time.Duration, cutoff time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT pet_id, recorded_at, health, hunger, happiness, money, xp FROM pet_stat_history WHERE resolution = ? AND recorded_at < ? ORDER BY pet_id, recorded_at",
+		from, cutoff.UTC())
+	if err != nil {
+		return err
+	}
+	type key struct {
+		petID int
+		start time.Time
+	}
+	sums := map[key]*historySample{}
+	counts := map[key]int{}
+	var order []key
+	for rows.Next() {
+		var petID int
+		var s historySample
+		if err := rows.Scan(&petID, &s.At, &s.Health, &s.Hunger, &s.Happiness, &s.Money, &s.XP); err != nil {
+			rows.Close()
+			return err
+		}
+		k := key{petID, s.At.UTC().Truncate(bucket)}
+		sum, ok := sums[k]
+		if !ok {
+			sum = &historySample{At: k.start}
+			sums[k] = sum
+			order = append(order, k)
+		}
+		sum.Health += s.Health
+		sum.Hunger += s.Hunger
+		sum.Happiness += s.Happiness
+		sum.Money += s.Money
+		sum.XP += s.XP
+		counts[k]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	for _, k := range order {
+		s, n := sums[k], float64(counts[k])
+		if _, err := tx.Exec("INSERT INTO pet_stat_history (pet_id, recorded_at, resolution, health, hunger, happiness, money, xp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			k.petID, k.start, to, s.Health/n, s.Hunger/n, s.Happiness/n, s.Money/n, s.XP/n); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM pet_stat_history WHERE resolution = ? AND recorded_at < ?", from, cutoff.UTC()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logMessage("stat_history_downsampled", map[string]interface{}{"from": from, "to": to, "buckets": len(order)})
+	return nil
+}
+
+// runHistoryDownsampling folds old stat history into coarser buckets once an hour until
+// the process exits. Cutoffs are aligned to bucket boundaries so no bucket is split.
+func runHistoryDownsampling() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		now := time.Now().UTC()
+		if err := downsampleHistory(resolutionRaw, resolutionHour, time.Hour, now.Add(-rawRetention).Truncate(time.Hour)); err != nil {
+			logMessage("stat_history_error", map[string]interface{}{"error": err.Error(), "context": "downsample_raw"})
+		}
+		if err := downsampleHistory(resolutionHour, resolutionDay, 24*time.Hour, now.Add(-hourlyRetention).Truncate(24*time.Hour)); err != nil {
+			logMessage("stat_history_error", map[string]interface{}{"error": err.Error(), "context": "downsample_hour"})
+		}
+	}
+}
+
+// historyPoint is one point of a GET /pets/{id}/history response. Min, Max and Samples
+// are only set when the request asks for a step.
+type historyPoint struct {
+	T       time.Time `json:"t"`
+	Value   float64   `json:"value"`
+	Min     *float64  `json:"min,omitempty"`
+	Max     *float64  `json:"max,omitempty"`
+	Samples int       `json:"samples,omitempty"`
+}
+
+// petHistoryHandler returns the time series of one stat of a pet.
+// Endpoint: GET /pets/{id}/history?stat=<stat>&from=<RFC 3339>&to=<RFC 3339>&step=<duration>
+// stat is one of health, hunger, happiness, money or xp. from and to default to the last
+// seven days. Without step every stored sample is returned; with step (e.g. "1h") samples
+// are averaged into UTC-aligned buckets of that length, with their min and max.
+// Response:
+// - 200 OK with the points, oldest first.
+// - 400 Bad Request if a parameter is invalid, the range exceeds 90 days, or too many points would be returned.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func petHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	stat := query.Get("stat")
+	if !historyStats[stat] {
+		http.Error(w, "stat must be one of health, hunger, happiness, money or xp", http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC()
+	var from time.Time
+	var err error
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	} else {
+		from = to.Add(-rawRetention)
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxHistoryRange {
+		http.Error(w, "The range may span at most 90 days", http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if v := query.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < time.Minute {
+			http.Error(w, "step must be a duration of at least 1m, e.g. 1h", http.StatusBadRequest)
+			return
+		}
+		if int(to.Sub(from)/step) > maxHistoryPoints {
+			http.Error(w, "step is too small for this range", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can read a pet's history", http.StatusForbidden)
+		return
+	}
+
+	// stat was checked against historyStats, so it is safe to use as a column name.
+	rows, err := db.Query("SELECT recorded_at, "+stat+" FROM pet_stat_history WHERE pet_id = ? AND recorded_at >= ? AND recorded_at <= ? ORDER BY recorded_at LIMIT ?",
+		petID, from.UTC(), to.UTC(), maxHistoryPoints*20+1)
+	if err != nil {
+		logMessage("stat_history_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	points := []historyPoint{}
+	for rows.Next() {
+		var at time.Time
+		var v float64
+		if err := rows.Scan(&at, &v); err != nil {
+			http.Error(w, "Error reading history", http.StatusInternalServerError)
+			return
+		}
+		if step == 0 {
+			points = append(points, historyPoint{T: at, Value: v})
+			continue
+		}
+		// Buckets are aligned to multiples of step since the Unix epoch, so "24h" means UTC days.
+		start := at.UTC().Truncate(step)
+		if n := len(points); n > 0 && points[n-1].T.Equal(start) {
+			p := &points[n-1]
+			p.Value += v
+			p.Samples++
+			if v < *p.Min {
+				*p.Min = v
+			}
+			if v > *p.Max {
+				*p.Max = v
+			}
+			continue
+		}
+		lo, hi := v, v
+		points = append(points, historyPoint{T: start, Value: v, Min: &lo, Max: &hi, Samples: 1})
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading history", http.StatusInternalServerError)
+		return
+	}
+	if len(points) > maxHistoryPoints {
+		http.Error(w, "Too many samples in this range; pass a larger step", http.StatusBadRequest)
+		return
+	}
+	for i := range points {
+		if points[i].Samples > 1 {
+			points[i].Value /= float64(points[i].Samples)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pet_id": petID,
+		"stat":   stat,
+		"from":   from.UTC(),
+		"to":     to.UTC(),
+		"step":   query.Get("step"),
+		"points": points,
+	})
+}
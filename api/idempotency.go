@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the idempotency_key of a WebSocket message.
+	maxIdempotencyKeyLength = 100
+	// idempotencyRetention is how long a stored response can answer a retried message.
+	idempotencyRetention = 24 * time.Hour
+)
+
+// errDuplicateRequest is returned by storeIdempotentResponseTx when another message with the
+// same key committed first. The caller must roll back and answer from the stored response.
+var errDuplicateRequest = errors.New("duplicate idempotency key")
+
+// idempotencyKey reads the idempotency_key of a WebSocket message.
+// Returns:
+// - The key, or "" if the message has none or it is too long.
+func idempotencyKey(message []byte) string {
+	var msg struct {
+		Key string `json:"idempotency_key"`
+	}
+	_ = json.Unmarshal(message, &msg)
+	if len(msg.Key) > maxIdempotencyKeyLength {
+		return ""
+	}
+	return msg.Key
+}
+
+// storeIdempotentResponseTx stores the response to a money-changing message in the same
+// transaction as the money change, so the change and its stored answer commit together.
+// Parameters:
+// - tx: The transaction the money changed in.
+// - userID: The ID of the caller.
+// - key: The message's idempotency key.
+// - response: The response that will be sent to the caller.
+// Returns:
+// - errDuplicateRequest if the key was already used, or another error if the write fails.
+func storeIdempotentResponseTx(tx *sql.Tx, userID int, key string, response interface{}) error {
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO idempotency_keys (user_id, idempotency_key, response, created_at) VALUES (?, ?, ?, ?)",
+		userID, key, string(b), time.Now().UTC())
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return errDuplicateRequest
+	}
+	return err
+}
+
+// replayIdempotentResponse answers a repeated message with the response stored for its key.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - key: The message's idempotency key.
+// Returns:
+// - true if a stored response was sent, false if the key has not been used.
+func replayIdempotentResponse(conn *websocket.Conn, userID int, key string) bool {
+	var response string
+	err := db.QueryRow("SELECT response FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", userID, key).Scan(&response)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logMessage("idempotency_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		}
+		return false
+	}
+	logMessage("idempotent_replay", map[string]interface{}{"user_id": userID, "idempotency_key": key})
+	writeConn(conn, json.RawMessage(response))
+	return true
+}
+
+// runIdempotencyCleanup deletes stored responses older than idempotencyRetention once an
+// hour until the process exits.
+func runIdempotencyCleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", time.Now().UTC().Add(-idempotencyRetention)); err != nil {
+			logMessage("idempotency_error", map[string]interface{}{"error": err.Error(), "context": "cleanup"})
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// inventoryEntry is one stack of items a pet owns. Both owners share it.
+type inventoryEntry struct {
+	Item        string    `json:"item"`
+	DisplayName string    `json:"display_name"`
+	Effect      string    `json:"effect"`
+	Magnitude   int       `json:"magnitude"`
+	Quantity    int       `json:"quantity"`
+	StackLimit  int       `json:"stack_limit"`
+	AcquiredAt  time.Time `json:"acquired_at"`
+}
+
+// loadInventory returns a pet's inventory in shop order.
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// Returns:
+// - The pet's stacks.
+// - An error if the query fails.
+func loadInventory(q sqlExecutor, petID int) ([]inventoryEntry, error) {
+	rows, err := q.Query(`SELECT i.id, i.display_name, i.effect, i.magnitude, v.quantity, i.stack_limit, v.acquired_at
+		FROM pet_inventory v JOIN items i ON i.id = v.item_id
+		WHERE v.pet_id = ? ORDER BY i.sort_order, i.id`, petID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []inventoryEntry{}
+	for rows.Next() {
+		var e inventoryEntry
+		if err := rows.Scan(&e.Item, &e.DisplayName, &e.Effect, &e.Magnitude, &e.Quantity, &e.StackLimit, &e.AcquiredAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// inventorySummary returns the item ids and quantities a pet owns, for PetDataResponse.
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// Returns:
+// - A map of item id to quantity.
+// - An error if the query fails.
+func inventorySummary(q sqlExecutor, petID int) (map[string]int, error) {
+	rows, err := q.Query("SELECT item_id, quantity FROM pet_inventory WHERE pet_id = ?", petID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	summary := map[string]int{}
+	for rows.Next() {
+		var item string
+		var quantity int
+		if err := rows.Scan(&item, &quantity); err != nil {
+			return nil, err
+		}
+		summary[item] = quantity
+	}
+	return summary, rows.Err()
+}
+
+// addToInventoryTx adds items to a pet's stack, up to the item's stack limit.
+// Parameters:
+// - tx: The transaction to run in.
+// - petID: The ID of the pet.
+// - item: The item, as loaded from the catalog.
+// - quantity: How many to add.
+// - now: The current time, recorded as acquired_at.
+// Returns:
+// - The new size of the stack.
+// - A *careRefusal if the stack would exceed its limit, or another error if a query fails.
+func addToInventoryTx(tx *sql.Tx, petID int, item *shopItem, quantity int, now time.Time) (int, error) {
+	var total int
+	err := tx.QueryRow(`INSERT INTO pet_inventory (pet_id, item_id, quantity, acquired_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (pet_id, item_id) DO UPDATE SET quantity = quantity + excluded.quantity, acquired_at = excluded.acquired_at
+		WHERE quantity + excluded.quantity <= ?
+		RETURNING quantity`, petID, item.ID, quantity, now.UTC(), item.StackLimit).Scan(&total)
+	if err == sql.ErrNoRows || (err == nil && total > item.StackLimit) {
+		return 0, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("A pet can hold at most %d %s", item.StackLimit, item.DisplayName)}
+	}
+	return total, err
+}
+
+// takeFromInventoryTx removes one item from a pet's stack, deleting the stack when it empties.
+// Parameters:
+// - tx: The transaction to run in.
+// - petID: The ID of the pet.
+// - itemID: The item id.
+// Returns:
+// - How many are left.
+// - false if the pet had none.
+// - An error if a query fails.
+func takeFromInventoryTx(tx *sql.Tx, petID int, itemID string) (int, bool, error) {
+	var left int
+	err := tx.QueryRow("UPDATE pet_inventory SET quantity = quantity - 1 WHERE pet_id = ? AND item_id = ? AND quantity > 0 RETURNING quantity",
+		petID, itemID).Scan(&left)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if left == 0 {
+		if _, err := tx.Exec("DELETE FROM pet_inventory WHERE pet_id = ? AND item_id = ?", petID, itemID); err != nil {
+			return 0, false, err
+		}
+	}
+	return left, true, nil
+}
+
+// itemQuantityLabel describes a number of items for feed messages, e.g. "an apple" or "3 × Apple".
+func itemQuantityLabel(item *shopItem, quantity int) string {
+	if quantity == 1 {
+		return item.Label
+	}
+	return fmt.Sprintf("%d × %s", quantity, item.DisplayName)
+}
+
+// buyItemTx buys items into a pet's inventory, paid from the pet's money.
+// Parameters:
+// - tx: The transaction to run in.
+// - pet: The pet to buy for.
+// - userID: The ID of the owner buying.
+// - item: The item, as loaded from the catalog.
+// - quantity: How many to buy.
+// - now: The current time.
+// Returns:
+// - The new size of the pet's stack.
+// - The activity entry recorded for the purchase.
+// - A *careRefusal if the items cannot be bought, or another error if a query fails.
+func buyItemTx(tx *sql.Tx, pet *petRecord, userID int, item *shopItem, quantity int, now time.Time) (int, *activityEntry, error) {
+	if !pet.isOwner(userID) {
+		return 0, nil, &careRefusal{Status: http.StatusForbidden, Message: "Only owners can buy items for a pet"}
+	}
+	if pet.State == statePassedAway {
+		return 0, nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has passed away", pet.Name)}
+	}
+	if quantity < 1 || quantity > item.StackLimit {
+		return 0, nil, &careRefusal{Status: http.StatusBadRequest, Message: fmt.Sprintf("quantity must be between 1 and %d", item.StackLimit)}
+	}
+	if err := chargeItemTx(tx, pet, userID, item, quantity, txReasonPurchase, now); err != nil {
+		return 0, nil, err
+	}
+	total, err := addToInventoryTx(tx, pet.ID, item, quantity, now)
+	if err != nil {
+		return 0, nil, err
+	}
+	entry, err := recordActivity(tx, pet.ID, userID, activityItemBought,
+		fmt.Sprintf("%s bought %s for %s", userDisplayName(tx, userID), itemQuantityLabel(item, quantity), pet.Name),
+		map[string]interface{}{"item": item.ID, "quantity": quantity, "cost": item.Price * quantity})
+	if err != nil {
+		return 0, nil, err
+	}
+	return total, entry, nil
+}
+
+// inventoryUpdateMessage builds the InventoryUpdate pushed to owners when a stack changes.
+func inventoryUpdateMessage(petID int, itemID string, quantity int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "InventoryUpdate",
+		"pet_id":   petID,
+		"item":     itemID,
+		"quantity": quantity,
+	}
+}
+
+// publishInventory pushes the new size of one of a pet's stacks to every connected owner.
+func publishInventory(p *petRecord, itemID string, quantity int) {
+	sendToOwners(p, inventoryUpdateMessage(p.ID, itemID, quantity))
+}
+
+// petInventoryHandler returns a pet's inventory.
+// Endpoint: GET /pets/{id}/inventory
+// Response:
+// - 200 OK with the pet's stacks.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func petInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can read a pet's inventory", http.StatusForbidden)
+		return
+	}
+	items, err := loadInventory(db, petID)
+	if err != nil {
+		logMessage("pet_inventory_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading inventory", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// useInventoryItemHandler gives a pet one item from its inventory, as a care action.
+// Endpoint: POST /pets/{id}/inventory/{item}/use
+// Response:
+// - 200 OK with the item id, how many are left, and the updated pet.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet or item does not exist.
+// - 409 Conflict if the pet has none of the item, or cannot use it right now.
+func useInventoryItemHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	item, err := loadItem(db, r.PathValue("item"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown item", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading item", http.StatusInternalServerError)
+		return
+	}
+	// Apply pending decay first so the effect lands on the pet's current stats.
+	if _, err := refreshPet(petID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		logMessage("use_item_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error using item", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := useItemTx(tx, petID, userID, item, true, time.Now())
+	if err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			http.Error(w, refusal.Message, refusal.Status)
+			return
+		}
+		logMessage("use_item_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "item": item.ID})
+		http.Error(w, "Error using item", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error using item", http.StatusInternalServerError)
+		return
+	}
+	publishCare(result, 0)
+
+	logMessage("use_item", map[string]interface{}{"pet_id": petID, "user_id": userID, "item": item.ID, "left": result.Remaining})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"item":     item.ID,
+		"quantity": result.Remaining,
+		"pet":      petData(result.Pet),
+	})
+}
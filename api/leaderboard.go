@@ -0,0 +1,423 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Leaderboard subjects: whether a metric ranks pets or players.
+const (
+	subjectPet  = "pet"
+	subjectUser = "user"
+)
+
+// Leaderboard aggregations: how a new value combines with a subject's existing score.
+const (
+	aggregateSum    = "sum"    // add the value to the score
+	aggregateMax    = "max"    // keep the highest value seen
+	aggregateLatest = "latest" // replace the score with the value
+)
+
+// allTimeSeason is the season_id under which all-time scores are stored.
+const allTimeSeason = 0
+
+// seasonLength is the duration of a weekly leaderboard season.
+const seasonLength = 7 * 24 * time.Hour
+
+// leaderboardMetric describes one leaderboard.
+type leaderboardMetric struct {
+	Subject   string
+	Aggregate string
+}
+
+// leaderboardMetrics lists the leaderboards the server maintains, keyed by the {metric}
+// path value of GET /leaderboards/{metric}.
+var leaderboardMetrics = map[string]leaderboardMetric{
+	"happiness":           {Subject: subjectPet, Aggregate: aggregateLatest},
+	"coins_earned":        {Subject: subjectPet, Aggregate: aggregateSum}, // every coin credit except gifts
+	"minigame_high_score": {Subject: subjectUser, Aggregate: aggregateMax},
+	"care_streak":         {Subject: subjectPet, Aggregate: aggregateMax},
+}
+
+// leaderboardRow is one ranked entry of a leaderboard response.
+type leaderboardRow struct {
+	Rank      int    `json:"rank"`
+	SubjectID int    `json:"subject_id"`
+	Name      string `json:"name"`
+	Score     int    `json:"score"`
+}
+
+// weekStart returns midnight UTC on the Monday of the week containing t.
+func weekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return day.AddDate(0, 0, -offset)
+}
+
+// currentSeasonID returns the ID of the weekly season that is still open.
+// Parameters:
+// - q: The database or transaction to read from.
+// Returns:
+// - The season ID.
+// - sql.ErrNoRows if no season is open, or another error if the query fails.
+func currentSeasonID(q sqlExecutor) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM leaderboard_seasons WHERE archived_at IS NULL ORDER BY id DESC LIMIT 1").Scan(&id)
+	return id, err
+}
+
+// rotateSeasons archives the open weekly season once it has ended and opens the season for
+// the current week. It also opens the first season on a fresh database.
+// Parameters:
+// - now: The current time.
+// Returns:
+// - An error if the rotation fails.
+func rotateSeasons(now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	var endsAt time.Time
+	err = tx.QueryRow("SELECT id, ends_at FROM leaderboard_seasons WHERE archived_at IS NULL ORDER BY id DESC LIMIT 1").Scan(&id, &endsAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case now.Before(endsAt):
+		return nil
+	default:
+		// Freeze the final standings, then clear the live rows so the next week starts from zero.
+		if _, err := tx.Exec(`INSERT INTO leaderboard_archive (season_id, metric, subject_id, rank, score)
+			SELECT season_id, metric, subject_id, RANK() OVER (PARTITION BY metric ORDER BY score DESC), score
+			FROM leaderboard_scores WHERE season_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM leaderboard_scores WHERE season_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE leaderboard_seasons SET archived_at = ? WHERE id = ?", now.UTC(), id); err != nil {
+			return err
+		}
+		logMessage("season_archived", map[string]interface{}{"season_id": id})
+	}
+
+	start := weekStart(now)
+	res, err := tx.Exec("INSERT INTO leaderboard_seasons (starts_at, ends_at) VALUES (?, ?)", start, start.Add(seasonLength))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	newID, _ := res.LastInsertId()
+	logMessage("season_started", map[string]interface{}{"season_id": newID, "starts_at": start})
+	return nil
+}
+
+// runSeasonRotation checks for the end of the weekly season in the background.
+func runSeasonRotation() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := rotateSeasons(time.Now()); err != nil {
+			logMessage("season_rotation_error", map[string]interface{}{"error": err.Error()})
+		}
+	}
+}
+
+// recordLeaderboardScore folds a new value into a subject's all-time and current weekly score.
+// Parameters:
+// - q: The database or transaction to write to, so scores commit with the change that earned them.
+// - metric: A key of leaderboardMetrics.
+// - subjectID: The pet or user ID, depending on the metric's subject.
+// - value: The value to combine with the existing score.
+// Returns:
+// - An error if the metric is unknown or the write fails.
+func recordLeaderboardScore(q sqlExecutor, metric string, subjectID int, value int) error {
+	m, ok := leaderboardMetrics[metric]
+	if !ok {
+		return fmt.Errorf("unknown leaderboard metric %q", metric)
+	}
+	var update string
+	switch m.Aggregate {
+	case aggregateSum:
+		update = "score = score + excluded.score"
+	case aggregateMax:
+		update = "score = MAX(score, excluded.score)"
+	default:
+		update = "score = excluded.score"
+	}
+
+	seasons := []int{allTimeSeason}
+	if id, err := currentSeasonID(q); err == nil {
+		seasons = append(seasons, id)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, seasonID := range seasons {
+		if _, err := q.Exec(`INSERT INTO leaderboard_scores (season_id, metric, subject_id, score, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (season_id, metric, subject_id) DO UPDATE SET `+update+`, updated_at = excluded.updated_at`,
+			seasonID, metric, subjectID, value, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaderboardScope returns the subject IDs a friends-only leaderboard is restricted to:
+// the caller and their friends, or the pets any of them own.
+// Parameters:
+// - userID: The caller's ID.
+// - subject: The metric's subject type.
+// Returns:
+// - The subject IDs.
+// - An error if a lookup fails.
+func leaderboardScope(userID int, subject string) ([]int, error) {
+	users, err := friendIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	users = append(users, userID)
+	if subject == subjectUser {
+		return users, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(users)), ",")
+	args := make([]interface{}, 0, 2*len(users))
+	for _, id := range users {
+		args = append(args, id)
+	}
+	args = append(args, args...)
+	rows, err := db.Query("SELECT id FROM pets WHERE main_owner IN ("+placeholders+") OR owner2 IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pets []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		pets = append(pets, id)
+	}
+	return pets, rows.Err()
+}
+
+// leaderboardName returns the label shown for a subject: a player's display name, or a
+// pet's name.
+func leaderboardName(subject string, subjectID int) string {
+	if subject == subjectUser {
+		return userDisplayName(db, subjectID)
+	}
+	pet, err := loadPet(db, subjectID)
+	if err != nil {
+		return ""
+	}
+	return pet.Name
+}
+
+// leaderboardHandler returns a page of a leaderboard along with the caller's own standing.
+// Endpoint: GET /leaderboards/{metric}?window=alltime|weekly&scope=global|friends&season=<id>&limit=<n>&offset=<n>
+// Passing season reads the frozen standings of an archived weekly season.
+// Response:
+// - 200 OK with the ranked entries and a "me" entry (null if the caller is unranked).
+// - 400 Bad Request if a parameter is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if the metric or season does not exist.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	metricName := r.PathValue("metric")
+	metric, ok := leaderboardMetrics[metricName]
+	if !ok {
+		http.Error(w, "Unknown leaderboard", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	limit, offset := parsePagination(r)
+
+	// Work out which table and season to read.
+	table := "leaderboard_scores"
+	seasonID := allTimeSeason
+	window := query.Get("window")
+	if window == "" {
+		window = "alltime"
+	}
+	switch {
+	case query.Get("season") != "":
+		id, err := strconv.Atoi(query.Get("season"))
+		if err != nil {
+			http.Error(w, "Invalid season", http.StatusBadRequest)
+			return
+		}
+		var archived sql.NullTime
+		if err := db.QueryRow("SELECT archived_at FROM leaderboard_seasons WHERE id = ?", id).Scan(&archived); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Season not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error reading season", http.StatusInternalServerError)
+			return
+		}
+		seasonID = id
+		window = "weekly"
+		if archived.Valid {
+			table = "leaderboard_archive"
+		}
+	case window == "weekly":
+		id, err := currentSeasonID(db)
+		if err != nil {
+			http.Error(w, "Error reading season", http.StatusInternalServerError)
+			return
+		}
+		seasonID = id
+	case window != "alltime":
+		http.Error(w, "window must be alltime or weekly", http.StatusBadRequest)
+		return
+	}
+
+	scope := query.Get("scope")
+	if scope == "" {
+		scope = "global"
+	}
+	filter := ""
+	args := []interface{}{seasonID, metricName}
+	switch scope {
+	case "global":
+	case "friends":
+		ids, err := leaderboardScope(userID, metric.Subject)
+		if err != nil {
+			logMessage("leaderboard_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+			http.Error(w, "Error reading friends", http.StatusInternalServerError)
+			return
+		}
+		if len(ids) == 0 {
+			ids = []int{0}
+		}
+		filter = " AND subject_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	default:
+		http.Error(w, "scope must be global or friends", http.StatusBadRequest)
+		return
+	}
+	// Pet boards only list living pets the caller may visit.
+	if metric.Subject == subjectPet {
+		visible, visibleArgs := visiblePetsQuery(userID)
+		filter += " AND subject_id IN (" + visible + ")"
+		args = append(args, visibleArgs...)
+	}
+
+	// Ranks are computed within the scope so friends boards start at #1.
+	ranked := "SELECT subject_id, score, RANK() OVER (ORDER BY score DESC) AS rnk FROM " + table + " WHERE season_id = ? AND metric = ?" + filter
+	rows, err := db.Query("SELECT subject_id, score, rnk FROM ("+ranked+") ORDER BY rnk, subject_id LIMIT ? OFFSET ?", append(args, limit+1, offset)...)
+	if err != nil {
+		logMessage("leaderboard_error", map[string]interface{}{"error": err.Error(), "metric": metricName})
+		http.Error(w, "Error reading leaderboard", http.StatusInternalServerError)
+		return
+	}
+	entries := []leaderboardRow{}
+	for rows.Next() {
+		var e leaderboardRow
+		if err := rows.Scan(&e.SubjectID, &e.Score, &e.Rank); err != nil {
+			rows.Close()
+			http.Error(w, "Error reading leaderboard", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	hasMore := len(entries) > limit
+	if hasMore {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Name = leaderboardName(metric.Subject, entries[i].SubjectID)
+	}
+
+	// The caller's own standing: themselves on player boards, their pet on pet boards.
+	var me *leaderboardRow
+	mySubject := userID
+	haveSubject := true
+	if metric.Subject == subjectPet {
+		petID, err := getUserPetID(userID)
+		mySubject, haveSubject = petID, err == nil
+	}
+	if haveSubject {
+		var row leaderboardRow
+		err := db.QueryRow("SELECT subject_id, score, rnk FROM ("+ranked+") WHERE subject_id = ?", append(args, mySubject)...).
+			Scan(&row.SubjectID, &row.Score, &row.Rank)
+		if err == nil {
+			row.Name = leaderboardName(metric.Subject, row.SubjectID)
+			me = &row
+		} else if err != sql.ErrNoRows {
+			http.Error(w, "Error reading leaderboard", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"metric":   metricName,
+		"subject":  metric.Subject,
+		"window":   window,
+		"scope":    scope,
+		"season":   seasonID,
+		"items":    entries,
+		"me":       me,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
+
+// leaderboardSeasonsHandler lists weekly seasons, newest first.
+// Endpoint: GET /leaderboards/seasons?limit=<n>&offset=<n>
+// Response:
+// - 200 OK with the seasons.
+// - 401 Unauthorized if the user is not authenticated.
+func leaderboardSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authenticateRequest(w, r); !ok {
+		return
+	}
+	limit, offset := parsePagination(r)
+	rows, err := db.Query("SELECT id, starts_at, ends_at, archived_at FROM leaderboard_seasons ORDER BY id DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		http.Error(w, "Error reading seasons", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type season struct {
+		ID         int        `json:"id"`
+		StartsAt   time.Time  `json:"starts_at"`
+		EndsAt     time.Time  `json:"ends_at"`
+		ArchivedAt *time.Time `json:"archived_at"`
+	}
+	seasons := []season{}
+	for rows.Next() {
+		var s season
+		var archived sql.NullTime
+		if err := rows.Scan(&s.ID, &s.StartsAt, &s.EndsAt, &archived); err != nil {
+			http.Error(w, "Error reading seasons", http.StatusInternalServerError)
+			return
+		}
+		if archived.Valid {
+			s.ArchivedAt = &archived.Time
+		}
+		seasons = append(seasons, s)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": seasons, "limit": limit, "offset": offset})
+}
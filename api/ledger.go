@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reason codes recorded in the transactions table.
+const (
+	txReasonSpend          = "spend"           // PetMoneyUpdate (legacy)
+	txReasonCare           = "care"            // Feed, Play or Heal; reference is the item
+	txReasonCure           = "cure"            // POST /pets/{id}/cure; reference is the remedy
+	txReasonMinigameReward = "minigame_reward" // reference is the session id
+	txReasonGiftSent       = "gift_sent"       // Gift; reference is the receiving pet's id
+	txReasonGiftReceived   = "gift_received"   // Gift; reference is the giving pet's id
+	txReasonReward         = "reward"          // Reward; reference is the source
+	txReasonPurchase       = "purchase"        // Purchase or POST /shop/buy; reference is the item
+	txReasonChestPurchase  = "chest_purchase"  // POST /chests/{chest}/buy; reference is the chest
+	txReasonChestReward    = "chest_reward"    // coins from a chest; reference is the opening id
+	txReasonStreakReward   = "streak_reward"   // ClaimStreak; reference is the streak day (YYYY-MM-DD)
+)
+
+// txReasons lists the reason codes accepted by the reason filter of GET /pets/{id}/transactions.
+var txReasons = map[string]bool{
+	txReasonSpend:          true,
+	txReasonCare:           true,
+	txReasonCure:           true,
+	txReasonMinigameReward: true,
+	txReasonGiftSent:       true,
+	txReasonGiftReceived:   true,
+	txReasonReward:         true,
+	txReasonPurchase:       true,
+	txReasonChestPurchase:  true,
+	txReasonChestReward:    true,
+	txReasonStreakReward:   true,
+}
+
+// moneyTransaction is one row of a pet's money ledger.
+type moneyTransaction struct {
+	ID           int64     `json:"id"`
+	PetID        int       `json:"pet_id"`
+	UserID       *int      `json:"user_id"`
+	Amount       int       `json:"amount"`
+	Reason       string    `json:"reason"`
+	Reference    string    `json:"reference,omitempty"`
+	BalanceAfter int       `json:"balance_after"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// recordTransaction appends a money change to a pet's ledger. It must run in the same
+// transaction as the balance update, after it, so balance_after is the committed balance.
+// Parameters:
+// - q: The transaction the balance was updated in.
+// - petID: The ID of the pet.
+// - userID: The user who caused the change, or 0 for the server.
+// - amount: The signed change in coins.
+// - reason: One of the txReason* codes.
+// - reference: What the change was for (an item, remedy or session id), or "".
+// Returns:
+// - The stored transaction.
+// - An error if the pet cannot be read or the insert fails.
+func recordTransaction(q sqlExecutor, petID, userID, amount int, reason, reference string) (*moneyTransaction, error) {
+	t := &moneyTransaction{PetID: petID, Amount: amount, Reason: reason, Reference: reference, CreatedAt: time.Now().UTC()}
+	if err := q.QueryRow("SELECT money FROM pets WHERE id = ?", petID).Scan(&t.BalanceAfter); err != nil {
+		return nil, err
+	}
+	var user sql.NullInt64
+	if userID != 0 {
+		t.UserID = &userID
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	ref := sql.NullString{String: reference, Valid: reference != ""}
+	res, err := q.Exec("INSERT INTO transactions (pet_id, user_id, amount, reason, reference, balance_after, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		petID, user, amount, reason, ref, t.BalanceAfter, t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.ID, _ = res.LastInsertId()
+	return t, nil
+}
+
+// petTransactionsHandler returns a page of a pet's money ledger, newest first.
+// Endpoint: GET /pets/{id}/transactions?limit=<n>&offset=<n>&before=<transaction id>&reason=<reason>
+// Passing the id of the oldest transaction already shown as "before" keeps pages stable while
+// new transactions keep arriving. reason restricts the page to one reason code.
+// Response:
+// - 200 OK with the transactions.
+// - 400 Bad Request if the reason is unknown.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func petTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can read a pet's transactions", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, offset := parsePagination(r)
+	before, err := strconv.ParseInt(query.Get("before"), 10, 64)
+	if err != nil || before <= 0 {
+		before = 1<<63 - 1
+	}
+	where := "pet_id = ? AND id < ?"
+	args := []interface{}{petID, before}
+	if reason := query.Get("reason"); reason != "" {
+		if !txReasons[reason] {
+			http.Error(w, "Unknown reason", http.StatusBadRequest)
+			return
+		}
+		where += " AND reason = ?"
+		args = append(args, reason)
+	}
+	args = append(args, limit+1, offset)
+
+	rows, err := db.Query("SELECT id, user_id, amount, reason, reference, balance_after, created_at FROM transactions WHERE "+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		logMessage("pet_transactions_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading transactions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []moneyTransaction{}
+	for rows.Next() {
+		t := moneyTransaction{PetID: petID}
+		var user sql.NullInt64
+		var ref sql.NullString
+		if err := rows.Scan(&t.ID, &user, &t.Amount, &t.Reason, &ref, &t.BalanceAfter, &t.CreatedAt); err != nil {
+			logMessage("pet_transactions_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+			http.Error(w, "Error reading transactions", http.StatusInternalServerError)
+			return
+		}
+		if user.Valid {
+			id := int(user.Int64)
+			t.UserID = &id
+		}
+		t.Reference = ref.String
+		items = append(items, t)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading transactions", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    items,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
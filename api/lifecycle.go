@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Pet lifecycle states, from best to worst.
+const (
+	stateHealthy    = "healthy"
+	stateSick       = "sick"
+	stateCritical   = "critical"
+	stateFainted    = "fainted"
+	statePassedAway = "passed_away"
+)
+
+// stateSeverity orders the lifecycle states so the engine can tell worsening from recovery.
+var stateSeverity = map[string]int{
+	stateHealthy:    0,
+	stateSick:       1,
+	stateCritical:   2,
+	stateFainted:    3,
+	statePassedAway: 4,
+}
+
+// criticalThreshold is the health below which a pet is critical. Below decay.SickThreshold
+// it is sick, and at the minimum stat it faints.
+const criticalThreshold = 15
+
+// faintGrace is how long a pet may stay fainted before it passes away. It can be changed
+// with LIFECYCLE_FAINT_GRACE.
+var faintGrace = 48 * time.Hour
+
+// remedy is something owners can buy from the pet's money to cure a lifecycle state.
+type remedy struct {
+	Cost  int
+	Cures []string
+	// Minimum stats after treatment; stats already above them are left alone.
+	Health, Hunger, Happiness int
+}
+
+// remedies are the cures available through POST /pets/{id}/cure, keyed by name.
+var remedies = map[string]remedy{
+	"medicine":  {Cost: 5, Cures: []string{stateSick}, Health: 50},
+	"vet_visit": {Cost: 15, Cures: []string{stateSick, stateCritical}, Health: 70},
+	"revive":    {Cost: 25, Cures: []string{stateFainted}, Health: 40, Hunger: 40, Happiness: 40},
+}
+
+// stateMessages are the feed lines recorded when a pet enters a state; %s is the pet's name.
+var stateMessages = map[string]string{
+	stateHealthy:    "%s is feeling better",
+	stateSick:       "%s is feeling sick",
+	stateCritical:   "%s is in critical condition",
+	stateFainted:    "%s has fainted",
+	statePassedAway: "%s has passed away",
+}
+
+// loadLifecycleConfig reads LIFECYCLE_FAINT_GRACE from the environment if it is set.
+func loadLifecycleConfig() {
+	if v := os.Getenv("LIFECYCLE_FAINT_GRACE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			faintGrace = d
+		} else {
+			logMessage("lifecycle_config_invalid", map[string]interface{}{"name": "LIFECYCLE_FAINT_GRACE", "value": v})
+		}
+	}
+}
+
+// stateForHealth returns the lifecycle state a pet's health alone calls for.
+func stateForHealth(health int) string {
+	switch {
+	case health <= minStat:
+		return stateFainted
+	case health < criticalThreshold:
+		return stateCritical
+	case health < decay.SickThreshold:
+		return stateSick
+	default:
+		return stateHealthy
+	}
+}
+
+// nextState decides a pet's lifecycle state. Pets only get worse on their own: recovering
+// health does not cure a state, a remedy does. A pet that stays fainted for faintGrace
+// passes away.
+// Parameters:
+// - p: The pet, with up-to-date stats.
+// - now: The current time.
+// Returns:
+// - The state the pet should be in.
+func nextState(p *petRecord, now time.Time) string {
+	if p.State == statePassedAway {
+		return statePassedAway
+	}
+	if p.State == stateFainted && p.StateSince.Valid && now.Sub(p.StateSince.Time) >= faintGrace {
+		return statePassedAway
+	}
+	if derived := stateForHealth(p.Health); stateSeverity[derived] > stateSeverity[p.State] {
+		return derived
+	}
+	return p.State
+}
+
+// setPetStateTx moves a pet to a new lifecycle state and records the change in its feed.
+// When the pet passes away it is archived in pet_memorials and detached from its owners so
+// they can adopt again.
+// Parameters:
+// - tx: The transaction to run in.
+// - p: The pet; its State and StateSince are updated.
+// - state: The new state.
+// - actorID: The user who caused the change, or 0 for changes the server initiates.
+// - now: The current time.
+// Returns:
+// - The activity entry to publish once the transaction commits.
+// - An error if a write fails.
+func setPetStateTx(tx *sql.Tx, p *petRecord, state string, actorID int, now time.Time) (*activityEntry, error) {
+	now = now.UTC()
+	previous := p.State
+	if _, err := tx.Exec("UPDATE pets SET state = ?, state_since = ? WHERE id = ?", state, now, p.ID); err != nil {
+		return nil, err
+	}
+	p.State = state
+	p.StateSince = sql.NullTime{Time: now, Valid: true}
+
+	if state == statePassedAway {
+		if err := archivePetTx(tx, p, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return recordActivity(tx, p.ID, actorID, activityStateChanged, fmt.Sprintf(stateMessages[state], p.Name),
+		map[string]interface{}{"state": state, "previous_state": previous})
+}
+
+// archivePetTx writes a pet's memorial and releases its owners, topping their coins up to
+// adoptionAllowance so they can adopt again.
+// Parameters:
+// - tx: The transaction to run in.
+// - p: The pet that passed away.
+// - now: The time of passing.
+// Returns:
+// - An error if a write fails.
+func archivePetTx(tx *sql.Tx, p *petRecord, now time.Time) error {
+	// The pet_created feed entry is the closest thing to a birth date the pets table has.
+	var adoptedAt sql.NullTime
+	err := tx.QueryRow("SELECT created_at FROM pet_activity WHERE pet_id = ? ORDER BY id LIMIT 1", p.ID).Scan(&adoptedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO pet_memorials (pet_id, name, species, main_owner, owner2, adopted_at, passed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, p.ID, p.Name, p.Species, p.MainOwner, p.Owner2, adoptedAt, now); err != nil {
+		return err
+	}
+	// The pet row stays for history; only the main owner's pointer is cleared. Co-owners are
+	// released by getUserPetID ignoring pets that have passed away.
+	if _, err := tx.Exec("UPDATE users SET pet_id = NULL WHERE pet_id = ?", p.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET coins = MAX(coins, ?) WHERE id IN (?, ?)", adoptionAllowance, p.MainOwner, p.Owner2)
+	return err
+}
+
+// publishPetState pushes a lifecycle change to every connected owner.
+// Parameters:
+// - p: The pet, already in its new state.
+// - previous: The state it left.
+func publishPetState(p *petRecord, previous string) {
+	sendToOwners(p, petStateMessage(p, previous))
+}
+
+// petStateMessage builds the PetStateChanged message for a pet.
+func petStateMessage(p *petRecord, previous string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":           "PetStateChanged",
+		"pet_id":         p.ID,
+		"state":          p.State,
+		"previous_state": previous,
+	}
+}
+
+// curePetHandler treats a pet with a remedy paid from the pet's money.
+// Endpoint: POST /pets/{id}/cure
+// Request Body:
+// - remedy: One of "medicine" (cures sick), "vet_visit" (cures sick or critical) or "revive" (cures fainted).
+// Response:
+// - 200 OK with the pet's new state, stats, money, XP, level and mood.
+// - 400 Bad Request if the body is invalid or the remedy is unknown.
+// - 401 Unauthorized if the user is not authenticated.
+// - 402 Payment Required if the pet cannot afford the remedy.
+// - 403 Forbidden if the caller does not own the pet, or the remedy breaks the pet's spending policy.
+// - 404 Not Found if the pet does not exist.
+// - 409 Conflict if the remedy does not cure the pet's current state.
+func curePetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Remedy string `json:"remedy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rem, known := remedies[req.Remedy]
+	if !known {
+		http.Error(w, "remedy must be one of medicine, vet_visit or revive", http.StatusBadRequest)
+		return
+	}
+
+	// Bring the pet up to date first so the remedy is judged against its real state.
+	if _, err := refreshPet(petID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can cure a pet", http.StatusForbidden)
+		return
+	}
+	cures := false
+	for _, s := range rem.Cures {
+		if s == pet.State {
+			cures = true
+		}
+	}
+	if !cures {
+		http.Error(w, fmt.Sprintf("%s does not help a pet that is %s", req.Remedy, pet.State), http.StatusConflict)
+		return
+	}
+
+	if err := checkSpendingTx(tx, pet, userID, rem.Cost, time.Now()); err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			http.Error(w, refusal.Message, refusal.Status)
+			return
+		}
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := tx.Exec("UPDATE pets SET money = money - ?, health = MAX(health, ?), hunger = MAX(hunger, ?), happiness = MAX(happiness, ?) WHERE id = ? AND money >= ?",
+		rem.Cost, rem.Health, rem.Hunger, rem.Happiness, petID, rem.Cost)
+	if err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, fmt.Sprintf("%s costs %d coins", req.Remedy, rem.Cost), http.StatusPaymentRequired)
+		return
+	}
+
+	if _, err := recordTransaction(tx, petID, userID, -rem.Cost, txReasonCure, req.Remedy); err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+
+	previous := pet.State
+	if pet, err = loadPet(tx, petID); err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	entry, err := setPetStateTx(tx, pet, stateForHealth(pet.Health), userID, time.Now())
+	if err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	vacation, vacationEntry, err := endVacationTx(tx, pet, userID, vacationEndedOnInteract, time.Now())
+	if err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	progress, err := awardXPTx(tx, pet, xpRewards["cure"], userID)
+	if err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	previousMood, moodChanged, err := updateMoodTx(tx, pet, time.Now())
+	if err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	if err := recordStatSample(tx, pet, time.Now()); err != nil {
+		logMessage("cure_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error curing pet", http.StatusInternalServerError)
+		return
+	}
+	publishActivity(entry)
+	publishVacationEnded(pet, vacation, vacationEntry)
+	publishPetStats(pet)
+	publishPetState(pet, previous)
+	publishProgress(pet, progress)
+	if moodChanged {
+		publishMood(pet, previousMood)
+	}
+
+	logMessage("cure_pet", map[string]interface{}{"pet_id": petID, "user_id": userID, "remedy": req.Remedy, "cost": rem.Cost})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"state":     pet.State,
+		"health":    pet.Health,
+		"hunger":    pet.Hunger,
+		"happiness": pet.Happiness,
+		"money":     pet.Money,
+		"xp":        pet.XP,
+		"level":     pet.Level,
+		"mood":      pet.Mood,
+	})
+}
+
+// petMemorial is an archived pet that has passed away.
+type petMemorial struct {
+	PetID     int        `json:"pet_id"`
+	Name      string     `json:"name"`
+	Species   string     `json:"species"`
+	MainOwner int        `json:"main_owner"`
+	Owner2    *int       `json:"owner2"`
+	AdoptedAt *time.Time `json:"adopted_at"`
+	PassedAt  time.Time  `json:"passed_at"`
+}
+
+// listMemorialsHandler returns the pets the caller has owned that have passed away, most recent first.
+// Endpoint: GET /memorials?limit=<n>&offset=<n>
+// Response:
+// - 200 OK with a page of memorials.
+// - 401 Unauthorized if the user is not authenticated.
+func listMemorialsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	limit, offset := parsePagination(r)
+
+	rows, err := db.Query(`SELECT pet_id, name, species, main_owner, owner2, adopted_at, passed_at FROM pet_memorials
+		WHERE main_owner = ? OR owner2 = ? ORDER BY passed_at DESC, pet_id DESC LIMIT ? OFFSET ?`,
+		userID, userID, limit+1, offset)
+	if err != nil {
+		logMessage("list_memorials_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error reading memorials", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	memorials := []petMemorial{}
+	for rows.Next() {
+		var m petMemorial
+		var owner2 sql.NullInt64
+		var adoptedAt sql.NullTime
+		if err := rows.Scan(&m.PetID, &m.Name, &m.Species, &m.MainOwner, &owner2, &adoptedAt, &m.PassedAt); err != nil {
+			http.Error(w, "Error reading memorials", http.StatusInternalServerError)
+			return
+		}
+		if owner2.Valid {
+			id := int(owner2.Int64)
+			m.Owner2 = &id
+		}
+		if adoptedAt.Valid {
+			m.AdoptedAt = &adoptedAt.Time
+		}
+		memorials = append(memorials, m)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading memorials", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(memorials) > limit
+	if hasMore {
+		memorials = memorials[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    memorials,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -31,11 +32,18 @@ type User struct {
 	Password string `json:"password"`
 }
 
+// PetMoneyUpdate is the deprecated raw spend message, accepted only when legacyMoneyUpdates is set.
 type PetMoneyUpdate struct {
-	PetID  int `json:"pet_id"`
-	Amount int `json:"amount"`
+	PetID          int    `json:"pet_id"`
+	Amount         int    `json:"amount"`
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
+// databaseOptions are appended to the SQLite DSN. Writers wait up to 5 seconds for a lock
+// instead of failing with SQLITE_BUSY, and transactions take the write lock when they begin,
+// so two transactions that read and then write can never deadlock upgrading their locks.
+const databaseOptions = "?_busy_timeout=5000&_txlock=immediate"
+
 var (
 	db                *sql.DB
 	oauth2Server      *server.Server
@@ -65,19 +73,32 @@ func hashPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
-// validateUserForeignKeys checks if a user has valid foreign key references for their pet and significant other.
+// validateUserForeignKeys checks that a user may open a WebSocket connection: they must
+// own or co-own a pet, and their significant other, if set, must reference an existing user.
 // Parameters:
 // - userID: The ID of the user to validate.
 // Returns:
 // - An error if the foreign keys are invalid or if the query fails.
 func validateUserForeignKeys(userID int) error {
-	var petID, soID sql.NullInt64
-	err := db.QueryRow("SELECT pet_id, SO FROM users WHERE id = ?", userID).Scan(&petID, &soID)
+	var soID sql.NullInt64
+	err := db.QueryRow("SELECT SO FROM users WHERE id = ?", userID).Scan(&soID)
 	if err != nil {
 		return err
 	}
-	if !petID.Valid || !soID.Valid {
-		return fmt.Errorf("invalid access: user %d has invalid foreign keys", userID)
+	if soID.Valid {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", soID.Int64).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("invalid access: user %d references a missing significant other", userID)
+		}
+	}
+	if _, err := getUserPetID(userID); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("invalid access: user %d has no pet", userID)
+		}
+		return err
 	}
 	return nil
 }
@@ -98,34 +119,142 @@ func getOtherOwner(petID int, currentOwnerID int) (sql.NullInt64, error) {
 	return otherOwnerID, nil
 }
 
-// validateAndUpdatePetMoney validates and updates the money attribute of a pet.
+// validateAndUpdatePetMoney validates and updates the money attribute of a pet. The balance
+// check and the update are a single conditional UPDATE, so concurrent spends by co-owners can
+// neither overdraw the pet nor overwrite each other. The ledger entry and the response stored
+// under the idempotency key commit in the same transaction.
 // Parameters:
 // - petID: The ID of the pet.
+// - userID: The ID of the user spending the money.
 // - amount: The amount to update the pet's money by.
+// - key: The message's idempotency key.
 // Returns:
 // - A boolean indicating if the update was valid.
 // - The new money value after the update.
-// - An error if the query fails.
-func validateAndUpdatePetMoney(petID int, amount int) (bool, int, error) {
-	var currentMoney int
-	err := db.QueryRow("SELECT money FROM pets WHERE id = ?", petID).Scan(&currentMoney)
+// - errDuplicateRequest if the key was already used, a *careRefusal if the spend breaks the pet's spending policy, or another error if the query fails.
+func validateAndUpdatePetMoney(petID int, userID int, amount int, key string) (bool, int, error) {
+	tx, err := db.Begin()
 	if err != nil {
 		return false, 0, err
 	}
+	defer tx.Rollback()
 
-	if amount > currentMoney {
-		return false, currentMoney, nil
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := checkSpendingTx(tx, pet, userID, amount, time.Now()); err != nil {
+		return false, 0, err
 	}
 
-	newMoney := currentMoney - amount
-	_, err = db.Exec("UPDATE pets SET money = ? WHERE id = ?", newMoney, petID)
+	var newMoney int
+	err = tx.QueryRow("UPDATE pets SET money = money - ? WHERE id = ? AND money >= ? RETURNING money", amount, petID, amount).Scan(&newMoney)
+	if err == sql.ErrNoRows {
+		var currentMoney int
+		if err := tx.QueryRow("SELECT money FROM pets WHERE id = ?", petID).Scan(&currentMoney); err != nil {
+			return false, 0, err
+		}
+		return false, currentMoney, nil
+	}
 	if err != nil {
 		return false, 0, err
 	}
+	if _, err := recordTransaction(tx, petID, userID, -amount, txReasonSpend, ""); err != nil {
+		return false, 0, err
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, moneyResultMessage(newMoney)); err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
 
 	return true, newMoney, nil
 }
 
+// moneyResultMessage builds the ResultResponse for a successful PetMoneyUpdate.
+func moneyResultMessage(newMoney int) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "ResultResponse",
+		"status":   "success",
+		"newMoney": newMoney,
+	}
+}
+
+// authenticateRequest validates the bearer token on the request and returns the caller's user id.
+// On failure the appropriate HTTP error has already been written.
+// Parameters:
+// - w: The response writer used to report authentication failures.
+// - r: The incoming request carrying the OAuth2 bearer token.
+// Returns:
+// - The authenticated user's ID.
+// - A boolean that is false when the request was rejected.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	token, err := oauth2Server.ValidationBearerToken(r)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	userIDStr := token.GetUserID()
+	if userIDStr == "" {
+		http.Error(w, "Token must be user-scoped", http.StatusUnauthorized)
+		return 0, false
+	}
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return 0, false
+	}
+	return userID, true
+}
+
+// writeJSON encodes a value as the JSON body of a response.
+// Parameters:
+// - w: The response writer.
+// - status: The HTTP status code to send.
+// - v: The value to encode.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logMessage("response_encode_error", map[string]interface{}{"error": err.Error()})
+	}
+}
+
+// parsePagination reads the limit and offset query parameters of a list endpoint.
+// The limit defaults to 20 and is capped at 50; invalid values fall back to the defaults.
+// Parameters:
+// - r: The incoming request.
+// Returns:
+// - The page size and the number of rows to skip.
+func parsePagination(r *http.Request) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > 50 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// lookupUserID resolves a username to the user's database ID.
+// Parameters:
+// - username: The username to resolve.
+// Returns:
+// - The user's ID.
+// - sql.ErrNoRows if no such user exists, or another error if the query fails.
+func lookupUserID(username string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	return id, err
+}
+
 func logMessage(event string, details map[string]interface{}) {
 	if logLevel == "development" {
 		log.Printf("Event: %s, Details: %v", event, details)
@@ -138,25 +267,62 @@ func logMessage(event string, details map[string]interface{}) {
 }
 
 // sendPingMessages periodically sends ping messages to keep the WebSocket connection alive.
+// It stops once the connection is no longer the user's active connection.
 // Parameters:
 // - userID: The ID of the user associated with the WebSocket connection.
-func sendPingMessages(userID int) {
+// - conn: The connection to ping.
+func sendPingMessages(userID int, conn *websocket.Conn) {
 	pingTicker := time.NewTicker(60 * time.Second)
 	defer pingTicker.Stop()
 
 	for range pingTicker.C {
 		connectionsMu.Lock()
-		if conn, ok := connections[userID]; ok {
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				logMessage("ping_failed", map[string]interface{}{"user_id": userID, "error": err.Error()})
-				conn.Close()
-				delete(connections, userID)
-			}
+		if connections[userID] != conn {
+			connectionsMu.Unlock()
+			return
+		}
+		if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			logMessage("ping_failed", map[string]interface{}{"user_id": userID, "error": err.Error()})
+			conn.Close()
+			delete(connections, userID)
 		}
 		connectionsMu.Unlock()
 	}
 }
 
+// writeConn sends a JSON message on a connection. Writes are serialized with
+// connectionsMu because pushes to a user can originate from other goroutines.
+// Parameters:
+// - conn: The connection to write to.
+// - v: The message to encode.
+// Returns:
+// - An error if the write fails.
+func writeConn(conn *websocket.Conn, v interface{}) error {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	return conn.WriteJSON(v)
+}
+
+// sendToUser pushes a JSON message to a user if they have an open WebSocket connection.
+// Parameters:
+// - userID: The ID of the recipient.
+// - v: The message to encode.
+// Returns:
+// - A boolean indicating if the user was connected and the write succeeded.
+func sendToUser(userID int, v interface{}) bool {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	conn, ok := connections[userID]
+	if !ok {
+		return false
+	}
+	if err := conn.WriteJSON(v); err != nil {
+		logMessage("ws_send_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		return false
+	}
+	return true
+}
+
 // websocketHandler handles WebSocket connections for real-time communication.
 // Endpoint: GET /ws
 // Behavior:
@@ -164,6 +330,7 @@ func sendPingMessages(userID int) {
 // - Establishes a WebSocket connection.
 // - Handles incoming messages and sends responses.
 // - Sends periodic ping messages to keep the connection alive.
+// - Pushes presence updates to the user's partner and co-owners on connect and disconnect.
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := oauth2Server.ValidationBearerToken(r)
 	if err != nil {
@@ -198,14 +365,22 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	connectionsMu.Lock()
 	connections[userID] = conn
 	connectionsMu.Unlock()
+	broadcastPresence(userID, true)
+	sendPresenceSnapshot(userID)
 
 	defer func() {
+		// Only remove the entry if it is still ours; a newer connection from the
+		// same user may already have replaced it.
 		connectionsMu.Lock()
-		if conn, ok := connections[userID]; ok {
-			conn.Close()
+		if connections[userID] == conn {
 			delete(connections, userID)
 		}
+		_, stillOnline := connections[userID]
 		connectionsMu.Unlock()
+		if !stillOnline {
+			markLastSeen(userID)
+			broadcastPresence(userID, false)
+		}
 	}()
 
 	conn.SetPongHandler(func(appData string) error {
@@ -213,7 +388,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	go sendPingMessages(userID)
+	go sendPingMessages(userID, conn)
 
 	for {
 		_, message, err := conn.ReadMessage()
@@ -233,98 +408,68 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Handle GetData request: return the caller's associated pet data
 		if strings.EqualFold(msgType.Type, "get_data") || strings.EqualFold(msgType.Type, "GetData") {
-			// Find the user's pet id (server-sourced)
-			var userPetID sql.NullInt64
-			if err := db.QueryRow("SELECT pet_id FROM users WHERE id = ?", userID).Scan(&userPetID); err != nil && err != sql.ErrNoRows {
-				logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
-				conn.WriteJSON(map[string]interface{}{
-					"type":    "PetDataResponse",
+			handleGetData(conn, userID)
+			continue
+		}
+		// Feed, Play and Heal care actions, and the typed economy operations.
+		switch action := strings.ToLower(msgType.Type); action {
+		case careFeed, carePlay, careHeal:
+			handleCare(conn, userID, action, message)
+			continue
+		case opPurchase:
+			handlePurchase(conn, userID, message)
+			continue
+		case opGift:
+			handleGift(conn, userID, message)
+			continue
+		case opReward:
+			handleReward(conn, userID, message)
+			continue
+		case opClaimStreak:
+			handleClaimStreak(conn, userID, message)
+			continue
+		case "ping", "pong":
+			continue
+		case "", "petmoneyupdate", "value_change_request":
+		default:
+			writeConn(conn, map[string]interface{}{
+				"type":    "ResultResponse",
+				"status":  "fail",
+				"message": fmt.Sprintf("Unknown message type %q", msgType.Type),
+			})
+			continue
+		}
+		// Raw money deltas are only accepted from old clients, and only as spends.
+		var updateData PetMoneyUpdate
+		if err := json.Unmarshal(message, &updateData); err == nil {
+			if !legacyMoneyUpdates {
+				writeConn(conn, map[string]interface{}{
+					"type":    "ResultResponse",
 					"status":  "fail",
-					"message": "Server error retrieving pet data",
+					"message": "PetMoneyUpdate is no longer supported; use Purchase, Gift or Reward",
 				})
 				continue
 			}
-
-			petIDToUse := 0
-			if userPetID.Valid {
-				petIDToUse = int(userPetID.Int64)
-			} else {
-				// Check if user is owner2
-				var petIDFromPets int
-				err := db.QueryRow("SELECT id FROM pets WHERE owner2 = ?", userID).Scan(&petIDFromPets)
-				if err != nil {
-					if err == sql.ErrNoRows {
-						conn.WriteJSON(map[string]interface{}{
-							"type":    "PetDataResponse",
-							"status":  "fail",
-							"message": "Caller has no pet",
-						})
-						continue
-					}
-					logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
-					conn.WriteJSON(map[string]interface{}{
-						"type":    "PetDataResponse",
-						"status":  "fail",
-						"message": "Server error retrieving pet data",
-					})
-					continue
-				}
-				petIDToUse = petIDFromPets
-			}
-
-			// Query pet data
-			var pet struct {
-				ID        int
-				Money     int
-				Health    int
-				Hunger    int
-				Happiness int
-				MainOwner int `db:"main_owner"`
-				Owner2    sql.NullInt64
-			}
-			row := db.QueryRow("SELECT id, money, health, hunger, happiness, main_owner, owner2 FROM pets WHERE id = ?", petIDToUse)
-			if err := row.Scan(&pet.ID, &pet.Money, &pet.Health, &pet.Hunger, &pet.Happiness, &pet.MainOwner, &pet.Owner2); err != nil {
-				if err == sql.ErrNoRows {
-					conn.WriteJSON(map[string]interface{}{
-						"type":    "PetDataResponse",
-						"status":  "fail",
-						"message": "Pet not found",
-					})
-					continue
-				}
-				logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "pet_id": petIDToUse})
-				conn.WriteJSON(map[string]interface{}{
-					"type":    "PetDataResponse",
+			if updateData.Amount <= 0 {
+				writeConn(conn, map[string]interface{}{
+					"type":    "ResultResponse",
 					"status":  "fail",
-					"message": "Server error retrieving pet data",
+					"message": "amount must be positive",
 				})
 				continue
 			}
-
-			// Build response object
-			petResp := map[string]interface{}{
-				"type":   "PetDataResponse",
-				"status": "success",
-				"pet": map[string]interface{}{
-					"id":         pet.ID,
-					"money":      pet.Money,
-					"health":     pet.Health,
-					"hunger":     pet.Hunger,
-					"happiness":  pet.Happiness,
-					"main_owner": pet.MainOwner,
-					"owner2":     nil,
-				},
+			// Retried messages are answered from the stored result instead of charging again.
+			if updateData.IdempotencyKey == "" || len(updateData.IdempotencyKey) > maxIdempotencyKeyLength {
+				writeConn(conn, map[string]interface{}{
+					"type":    "ResultResponse",
+					"status":  "fail",
+					"message": "idempotency_key is required",
+				})
+				continue
 			}
-			if pet.Owner2.Valid {
-				petResp["pet"].(map[string]interface{})["owner2"] = int(pet.Owner2.Int64)
+			if replayIdempotentResponse(conn, userID, updateData.IdempotencyKey) {
+				continue
 			}
-
-			conn.WriteJSON(petResp)
-			continue
-		}
-		// Notify other owner if applicable
-		var updateData PetMoneyUpdate
-		if err := json.Unmarshal(message, &updateData); err == nil {
 			// Derive the pet ID from server-side state (ignore client-supplied pet_id).
 			// First, try the user's pet_id column. If not present, check if the user
 			// is a co-owner (owner2) in the pets table.
@@ -332,7 +477,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			err := db.QueryRow("SELECT pet_id FROM users WHERE id = ?", userID).Scan(&userPetID)
 			if err != nil && err != sql.ErrNoRows {
 				logMessage("pet_money_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
-				conn.WriteJSON(map[string]interface{}{
+				writeConn(conn, map[string]interface{}{
 					"type":    "ResultResponse",
 					"status":  "fail",
 					"message": "Server error occurred",
@@ -346,10 +491,10 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			} else {
 				// Try to find a pet where this user is owner2
 				var petIDFromPets int
-				err = db.QueryRow("SELECT id FROM pets WHERE owner2 = ?", userID).Scan(&petIDFromPets)
+				err = db.QueryRow("SELECT id FROM pets WHERE owner2 = ? AND state != ?", userID, statePassedAway).Scan(&petIDFromPets)
 				if err != nil {
 					if err == sql.ErrNoRows {
-						conn.WriteJSON(map[string]interface{}{
+						writeConn(conn, map[string]interface{}{
 							"type":    "ResultResponse",
 							"status":  "fail",
 							"message": "Caller has no pet to operate on",
@@ -357,7 +502,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 						continue
 					}
 					logMessage("pet_money_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
-					conn.WriteJSON(map[string]interface{}{
+					writeConn(conn, map[string]interface{}{
 						"type":    "ResultResponse",
 						"status":  "fail",
 						"message": "Server error occurred",
@@ -370,10 +515,23 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			// Override whatever the client sent and use the server-derived pet id.
 			updateData.PetID = petIDToUse
 
-			valid, newMoney, err := validateAndUpdatePetMoney(updateData.PetID, updateData.Amount)
+			valid, newMoney, err := validateAndUpdatePetMoney(updateData.PetID, userID, updateData.Amount, updateData.IdempotencyKey)
+			if err == errDuplicateRequest {
+				replayIdempotentResponse(conn, userID, updateData.IdempotencyKey)
+				continue
+			}
+			var refusal *careRefusal
+			if errors.As(err, &refusal) {
+				writeConn(conn, map[string]interface{}{
+					"type":    "ResultResponse",
+					"status":  "fail",
+					"message": refusal.Message,
+				})
+				continue
+			}
 			if err != nil {
 				logMessage("pet_money_error", map[string]interface{}{"error": err.Error(), "pet_id": updateData.PetID})
-				conn.WriteJSON(map[string]interface{}{
+				writeConn(conn, map[string]interface{}{
 					"type":    "ResultResponse",
 					"status":  "fail",
 					"message": "Server error occurred",
@@ -382,7 +540,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if !valid {
-				conn.WriteJSON(map[string]interface{}{
+				writeConn(conn, map[string]interface{}{
 					"type":    "ResultResponse",
 					"status":  "fail",
 					"message": "Insufficient funds. Pet money cannot go below 0.",
@@ -390,26 +548,25 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			conn.WriteJSON(map[string]interface{}{
-				"type":     "ResultResponse",
-				"status":   "success",
-				"newMoney": newMoney,
-			})
+			writeConn(conn, moneyResultMessage(newMoney))
+
+			samplePet(updateData.PetID)
+			endVacationOnInteraction(updateData.PetID, userID)
+			logPetActivity(updateData.PetID, userID, activityMoneySpent,
+				fmt.Sprintf("%s spent %d coins", userDisplayName(db, userID), updateData.Amount),
+				map[string]interface{}{"amount": updateData.Amount, "new_money": newMoney})
 
 			otherOwnerID, err := getOtherOwner(updateData.PetID, userID)
 			if err == nil && otherOwnerID.Valid {
-				connectionsMu.Lock()
-				if otherConn, ok := connections[int(otherOwnerID.Int64)]; ok {
-					// Broadcast the original message but annotate pet_id with the server-derived value
-					// so the recipient sees the authoritative pet id.
-					annotated := map[string]interface{}{}
-					_ = json.Unmarshal(message, &annotated)
-					annotated["pet_id"] = updateData.PetID
-					if err = otherConn.WriteJSON(annotated); err != nil {
-						logMessage("ws_send_error", map[string]interface{}{"error": err.Error()})
-					}
+				// Broadcast the original message but annotate pet_id with the server-derived value
+				// so the recipient sees the authoritative pet id.
+				annotated := map[string]interface{}{}
+				_ = json.Unmarshal(message, &annotated)
+				annotated["pet_id"] = updateData.PetID
+				if pet, err := loadPet(db, updateData.PetID); err == nil {
+					annotated["pet_name"] = pet.Name
 				}
-				connectionsMu.Unlock()
+				sendToUser(int(otherOwnerID.Int64), annotated)
 			}
 		}
 	}
@@ -418,11 +575,12 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 // createUserHandler handles the creation of a new user account.
 // Endpoint: POST /create_user
 // Request Body:
+// - name: Optional display name shown to other users (at most 50 characters).
 // - username: The username of the new user.
 // - password: The plaintext password of the new user.
 // Response:
 // - 201 Created on success.
-// - 400 Bad Request if the request body is invalid.
+// - 400 Bad Request if the request body is invalid or the name is too long.
 // - 500 Internal Server Error if user creation fails.
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -431,6 +589,7 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type CreateUserRequest struct {
+		Name     string `json:"name"`
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
@@ -441,14 +600,21 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	name := strings.TrimSpace(req.Name)
+	if len([]rune(name)) > maxDisplayNameLength {
+		http.Error(w, fmt.Sprintf("name must be at most %d characters", maxDisplayNameLength), http.StatusBadRequest)
+		return
+	}
+
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Error hashing password", http.StatusInternalServerError)
 		return
 	}
 
-	// Updated INSERT statement to include name
-	_, err = db.Exec("INSERT INTO users (username, password, SO, pet_id) VALUES (?, ?, NULL, NULL)", req.Username, hashedPassword)
+	displayName := sql.NullString{String: name, Valid: name != ""}
+	_, err = db.Exec("INSERT INTO users (username, password, SO, pet_id, display_name, coins) VALUES (?, ?, NULL, NULL, ?, ?)",
+		req.Username, hashedPassword, displayName, adoptionAllowance)
 	if err != nil {
 		logMessage("create_user_error", map[string]interface{}{"error": err.Error()})
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
@@ -464,11 +630,14 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 // createPetHandler handles the creation of a new pet for the authenticated user.
 // Endpoint: POST /create_pet
 // Request Body:
-// - name: The name of the new pet.
+// - name: The name of the new pet (see validatePetName). Defaults to the species' name.
+// - species: The species to adopt (see GET /species). Defaults to "pink_motchi".
 // Response:
 // - 201 Created on success.
-// - 400 Bad Request if the request body is invalid.
+// - 400 Bad Request if the request body is invalid, the name is not allowed, or the species is unknown.
 // - 401 Unauthorized if the user is not authenticated.
+// - 402 Payment Required if the user cannot afford the species' adoption cost.
+// - 409 Conflict if the user already owns or co-owns a pet that has not passed away.
 // - 500 Internal Server Error if pet creation fails.
 func createPetHandler(w http.ResponseWriter, r *http.Request) {
 	token, err := oauth2Server.ValidationBearerToken(r)
@@ -489,10 +658,11 @@ func createPetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// No request body required for create_pet; the server will create a default pet for the caller.
-	// Keep compatibility: attempt to decode but ignore any provided name.
+	// The body is optional; without one the caller adopts the default species,
+	// named after the species.
 	type CreatePetRequest struct {
-		Name string `json:"name"`
+		Name    string `json:"name"`
+		Species string `json:"species"`
 	}
 
 	var req CreatePetRequest
@@ -500,6 +670,27 @@ func createPetHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.Species == "" {
+		req.Species = defaultSpecies
+	}
+	species, err := loadSpecies(db, req.Species)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown species", http.StatusBadRequest)
+			return
+		}
+		logMessage("create_pet_error", map[string]interface{}{"error": err.Error(), "user_id": userIDStr, "species": req.Species})
+		http.Error(w, "Error reading species", http.StatusInternalServerError)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		req.Name = species.DisplayName
+	}
+	petName, err := validatePetName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Ensure the user exists and then create the pet in a transaction so we can
 	// set users.pet_id to the newly-created pet id (avoids foreign key issues).
@@ -528,29 +719,23 @@ func createPetHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	res, err := tx.Exec("INSERT INTO pets (main_owner, owner2, money, health, hunger, happiness) VALUES (?, NULL, 0, 100, 100, 100)", userIDInt)
+	petID, err := adoptPetTx(tx, userIDInt, species, petName)
 	if err != nil {
 		tx.Rollback()
-		logMessage("create_pet_error", map[string]interface{}{"error": err.Error(), "user_id": userIDStr})
-		http.Error(w, "Error creating pet", http.StatusInternalServerError)
-		return
-	}
-	petID64, err := res.LastInsertId()
-	if err != nil {
-		tx.Rollback()
-		logMessage("create_pet_error", map[string]interface{}{"error": err.Error(), "user_id": userIDStr})
+		if err == errAlreadyHasPet {
+			logMessage("create_pet_failed", map[string]interface{}{"user_id": userIDStr, "reason": "already_has_pet"})
+			http.Error(w, "You already have a pet", http.StatusConflict)
+			return
+		}
+		if err == errInsufficientCoins {
+			logMessage("create_pet_failed", map[string]interface{}{"user_id": userIDStr, "species": species.ID, "reason": "insufficient_coins"})
+			http.Error(w, fmt.Sprintf("Adopting a %s costs %d coins", species.DisplayName, species.AdoptionCost), http.StatusPaymentRequired)
+			return
+		}
+		logMessage("create_pet_error", map[string]interface{}{"error": err.Error(), "user_id": userIDStr, "species": species.ID})
 		http.Error(w, "Error creating pet", http.StatusInternalServerError)
 		return
 	}
-	petID := int(petID64)
-
-	// Update the user's pet_id to the new pet id.
-	if _, err := tx.Exec("UPDATE users SET pet_id = ? WHERE id = ?", petID, userIDInt); err != nil {
-		tx.Rollback()
-		logMessage("create_pet_error", map[string]interface{}{"error": err.Error(), "user_id": userIDStr, "pet_id": petID})
-		http.Error(w, "Error linking pet to user", http.StatusInternalServerError)
-		return
-	}
 
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
@@ -559,7 +744,10 @@ func createPetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logMessage("create_pet", map[string]interface{}{"user_id": userIDStr, "pet_id": petID})
+	logMessage("create_pet", map[string]interface{}{"user_id": userIDStr, "pet_id": petID, "pet_name": petName, "species": species.ID, "cost": species.AdoptionCost})
+	logPetActivity(petID, userIDInt, activityPetCreated,
+		fmt.Sprintf("%s adopted %s the %s for %d coins", userDisplayName(db, userIDInt), petName, species.DisplayName, species.AdoptionCost),
+		map[string]interface{}{"species": species.ID, "cost": species.AdoptionCost, "name": petName})
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Pet created successfully"))
@@ -654,6 +842,7 @@ func connectHandler(w http.ResponseWriter, r *http.Request) {
 // - 200 OK on success.
 // - 400 Bad Request if the request body is invalid.
 // - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if either user has blocked the other.
 // - 404 Not Found if user or pet not found.
 // - 500 Internal Server Error if the update fails.
 func addCoOwnerHandler(w http.ResponseWriter, r *http.Request) {
@@ -710,6 +899,17 @@ func addCoOwnerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Invitations are refused in both directions once either user has blocked the other.
+	blocked, err := isBlockedBetween(userID, targetUserID)
+	if err != nil {
+		http.Error(w, "Error checking blocks", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "Cannot invite this user", http.StatusForbidden)
+		return
+	}
+
 	// Update pets.owner2 where appropriate
 	res, err := db.Exec("UPDATE pets SET owner2 = ? WHERE id = ? AND owner2 IS NULL", targetUserID, int(petID.Int64))
 	if err != nil {
@@ -723,6 +923,9 @@ func addCoOwnerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logMessage("add_co_owner", map[string]interface{}{"pet_id": petID.Int64, "new_owner_username": req.Username, "new_owner_id": targetUserID})
+	logPetActivity(int(petID.Int64), userID, activityCoOwnerAdded,
+		fmt.Sprintf("%s joined as co-owner", userDisplayName(db, targetUserID)),
+		map[string]interface{}{"co_owner_id": targetUserID})
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Co-owner added successfully"))
@@ -742,12 +945,92 @@ func checkOAuthServer() error {
 	return nil
 }
 
+// columnMigrations lists columns added to tables after their first release.
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so each entry is
+// added with ALTER TABLE when the running database does not have it yet.
+var columnMigrations = []struct {
+	Table      string
+	Column     string
+	Definition string
+}{
+	{"pets", "species", "TEXT NOT NULL DEFAULT 'pink_motchi'"},
+	{"pets", "name", "TEXT NOT NULL DEFAULT 'Motchi'"},
+	{"users", "display_name", "TEXT"},
+	{"users", "private", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "last_seen", "TIMESTAMP"},
+	{"users", "coins", "INTEGER NOT NULL DEFAULT 20 CHECK(coins >= 0)"},
+	{"pets", "visibility", "TEXT NOT NULL DEFAULT 'friends' CHECK(visibility IN ('private', 'friends', 'public'))"},
+	{"pets", "last_updated", "TIMESTAMP"},
+	{"pets", "decay_steps", "INTEGER NOT NULL DEFAULT 0"},
+	{"pets", "state", "TEXT NOT NULL DEFAULT 'healthy'"},
+	{"pets", "state_since", "TIMESTAMP"},
+	{"pets", "xp", "INTEGER NOT NULL DEFAULT 0 CHECK(xp >= 0)"},
+	{"pets", "level", "INTEGER NOT NULL DEFAULT 1"},
+	{"pets", "stage", "TEXT NOT NULL DEFAULT 'baby'"},
+	{"pets", "mood", "TEXT NOT NULL DEFAULT 'content'"},
+	{"users", "timezone", "TEXT NOT NULL DEFAULT 'UTC'"},
+	{"users", "quiet_start", "TEXT"},
+	{"users", "quiet_end", "TEXT"},
+	{"items", "stack_limit", "INTEGER NOT NULL DEFAULT 10 CHECK(stack_limit > 0)"},
+}
+
+// dataMigrations set seed data that depends on columnMigrations. They run after the column
+// migrations on every start, so each must be safe to repeat and must leave values an
+// operator has changed alone.
+var dataMigrations = []struct {
+	Statement string
+	Args      []interface{}
+}{
+	// Rarer shop items stack lower than the default of 10. Only rows still at the column
+	// default are touched, so limits an operator has changed survive restarts.
+	{"UPDATE items SET stack_limit = CASE id WHEN 'cake' THEN 5 ELSE 3 END WHERE id IN ('cake', 'golden_apple', 'rocket_toy') AND stack_limit = 10", nil},
+}
+
+// migrateSchema adds any missing columns listed in columnMigrations, then runs dataMigrations.
+// Returns:
+// - An error if a table cannot be inspected or altered.
+func migrateSchema() error {
+	for _, m := range columnMigrations {
+		rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", m.Table))
+		if err != nil {
+			return err
+		}
+		found := false
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, colType string
+			var dflt sql.NullString
+			if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+				rows.Close()
+				return err
+			}
+			if name == m.Column {
+				found = true
+			}
+		}
+		rows.Close()
+		if found {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.Table, m.Column, m.Definition)); err != nil {
+			return fmt.Errorf("adding %s.%s: %v", m.Table, m.Column, err)
+		}
+		logMessage("schema_migrated", map[string]interface{}{"table": m.Table, "column": m.Column})
+	}
+	for _, m := range dataMigrations {
+		if _, err := db.Exec(m.Statement, m.Args...); err != nil {
+			return fmt.Errorf("migrating data: %v", err)
+		}
+	}
+	return nil
+}
+
 func init_servers() {
 	// Load .env for local development so os.Getenv picks up values from the .env file.
 	// Ignore error: absence of .env is okay in production.
 	_ = godotenv.Load(".env")
 	var err error
-	db, err = sql.Open("sqlite3", "./game.db")
+	db, err = sql.Open("sqlite3", "./game.db"+databaseOptions)
 	if err != nil {
 		logMessage("fatal", map[string]interface{}{"error": err.Error(), "context": "db_connect"})
 		log.Fatalf("Failed to connect to the database: %v", err)
@@ -772,6 +1055,18 @@ func init_servers() {
 		log.Fatalf("Failed to execute schema SQL: %v", err)
 	}
 
+	// Bring databases created from an older schema.sql up to date.
+	if err := migrateSchema(); err != nil {
+		logMessage("fatal", map[string]interface{}{"error": err.Error(), "context": "migrate_schema"})
+		log.Fatalf("Failed to migrate schema: %v", err)
+	}
+
+	// Make sure a weekly leaderboard season is open.
+	if err := rotateSeasons(time.Now()); err != nil {
+		logMessage("fatal", map[string]interface{}{"error": err.Error(), "context": "leaderboard_seasons"})
+		log.Fatalf("Failed to open leaderboard season: %v", err)
+	}
+
 	// Use the OAuth2 setup functions from oauth_setup.go
 	// Pass clientID and clientSecret to the OAuth2 setup functions
 	// Read client credentials from environment variables (fall back to defaults only for dev)
@@ -794,6 +1089,11 @@ func init_servers() {
 	if logLevel == "" {
 		logLevel = "production" // Default to production
 	}
+
+	// Stat decay tunables (DECAY_*).
+	loadDecayConfig()
+	loadLifecycleConfig()
+	loadEconomyConfig()
 }
 
 // main initializes the server and sets up the HTTP routes.
@@ -801,9 +1101,39 @@ func init_servers() {
 // - POST /create_user: Create a new user account.
 // - POST /create_pet: Create a new pet for the authenticated user.
 // - POST /add_co_owner: Add another user as a co-owner of a pet.
+// - GET /species: List adoptable species and their costs.
+// - GET /shop, POST /shop/buy: List the shop catalog and buy items into the caller's pet's inventory.
+// - GET /pets/{id}/inventory, POST /pets/{id}/inventory/{item}/use: List and use a pet's items.
+// - GET /pets/{id}/streak: Read a pet's care streak and reward calendar.
+// - GET, PUT /pets/{id}/spending: Read and set the main owner's limits on owner2's spending.
+// - GET /pets/{id}/spending/requests, POST /pets/{id}/spending/requests/{request}/approve|deny: Audit and decide purchases awaiting approval.
+// - GET /chests, POST /chests/{chest}/buy, POST /chests/{chest}/open: List, buy and open loot chests.
+// - GET /chests/seed, POST /chests/seed/rotate, GET /chests/openings: Inspect and reveal chest seeds and audit openings.
+// - GET /friends: List the caller's friends and pending friend requests.
+// - POST /friends/requests, POST /friends/requests/{id}/{accept|decline}: Send or answer friend requests.
+// - DELETE /friends/{userID}: Remove a friend.
+// - POST /blocks, DELETE /blocks/{userID}: Block or unblock another user.
+// - GET /pets/{id}: Read-only visit to a pet, subject to its privacy setting.
+// - PUT /pets/{id}/privacy: Change who may visit a pet.
+// - PUT /pets/{id}/name: Rename a pet.
+// - GET /pets/{id}/activity: Page through a pet's activity feed.
+// - POST /pets/{id}/cure: Treat a sick, critical or fainted pet.
+// - GET /pets/{id}/progress: A pet's level, evolution stage and unlocks.
+// - GET /pets/{id}/history: Time series of one of a pet's stats.
+// - GET /pets/{id}/transactions: Page through a pet's money ledger.
+// - POST /pets/{id}/vacation, DELETE /pets/{id}/vacation: Start or end a vacation that pauses a pet's needs.
+// - GET /memorials: List the caller's pets that have passed away.
+// - POST /minigames/{game}/sessions, POST /minigames/{game}/sessions/{id}/complete: Play a minigame round for coins.
+// - GET /leaderboards/{metric}, GET /leaderboards/seasons: Global and friends leaderboards.
+// - GET /users/search: Prefix search over usernames and display names.
+// - PUT /profile: Update the caller's display name, search visibility, time zone and quiet hours.
 // - GET /ws: Establish a WebSocket connection.
 func main() {
 	init_servers()
+	go runSeasonRotation()
+	go runDecayTicker()
+	go runHistoryDownsampling()
+	go runIdempotencyCleanup()
 
 	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
 		// Ensure the request's grant_type is one we allow. We only permit
@@ -839,6 +1169,46 @@ func main() {
 	http.HandleFunc("/add_co_owner", addCoOwnerHandler)
 	http.HandleFunc("/connect", connectHandler)
 	http.HandleFunc("/ws", websocketHandler)
+	http.HandleFunc("GET /species", listSpeciesHandler)
+	http.HandleFunc("GET /shop", listShopHandler)
+	http.HandleFunc("POST /shop/buy", buyItemHandler)
+	http.HandleFunc("GET /pets/{id}/inventory", petInventoryHandler)
+	http.HandleFunc("POST /pets/{id}/inventory/{item}/use", useInventoryItemHandler)
+	http.HandleFunc("GET /pets/{id}/streak", petStreakHandler)
+	http.HandleFunc("GET /pets/{id}/spending", spendingPolicyHandler)
+	http.HandleFunc("PUT /pets/{id}/spending", updateSpendingPolicyHandler)
+	http.HandleFunc("GET /pets/{id}/spending/requests", spendingRequestsHandler)
+	http.HandleFunc("POST /pets/{id}/spending/requests/{request}/approve", decideSpendingRequestHandler(true))
+	http.HandleFunc("POST /pets/{id}/spending/requests/{request}/deny", decideSpendingRequestHandler(false))
+	http.HandleFunc("GET /chests", listChestsHandler)
+	http.HandleFunc("POST /chests/{chest}/buy", buyChestHandler)
+	http.HandleFunc("POST /chests/{chest}/open", openChestHandler)
+	http.HandleFunc("GET /chests/seed", chestSeedHandler)
+	http.HandleFunc("POST /chests/seed/rotate", rotateChestSeedHandler)
+	http.HandleFunc("GET /chests/openings", chestOpeningsHandler)
+	http.HandleFunc("GET /friends", listFriendsHandler)
+	http.HandleFunc("POST /friends/requests", sendFriendRequestHandler)
+	http.HandleFunc("POST /friends/requests/{id}/{action}", respondFriendRequestHandler)
+	http.HandleFunc("DELETE /friends/{userID}", removeFriendHandler)
+	http.HandleFunc("POST /blocks", blockUserHandler)
+	http.HandleFunc("DELETE /blocks/{userID}", unblockUserHandler)
+	http.HandleFunc("GET /pets/{id}", visitPetHandler)
+	http.HandleFunc("PUT /pets/{id}/privacy", setPetPrivacyHandler)
+	http.HandleFunc("PUT /pets/{id}/name", renamePetHandler)
+	http.HandleFunc("GET /pets/{id}/activity", petActivityHandler)
+	http.HandleFunc("POST /pets/{id}/cure", curePetHandler)
+	http.HandleFunc("GET /pets/{id}/progress", petProgressHandler)
+	http.HandleFunc("GET /pets/{id}/history", petHistoryHandler)
+	http.HandleFunc("GET /pets/{id}/transactions", petTransactionsHandler)
+	http.HandleFunc("POST /pets/{id}/vacation", startVacationHandler)
+	http.HandleFunc("DELETE /pets/{id}/vacation", endVacationHandler)
+	http.HandleFunc("GET /memorials", listMemorialsHandler)
+	http.HandleFunc("POST /minigames/{game}/sessions", startMinigameHandler)
+	http.HandleFunc("POST /minigames/{game}/sessions/{id}/complete", completeMinigameHandler)
+	http.HandleFunc("GET /leaderboards/seasons", leaderboardSeasonsHandler)
+	http.HandleFunc("GET /leaderboards/{metric}", leaderboardHandler)
+	http.HandleFunc("GET /users/search", searchUsersHandler)
+	http.HandleFunc("PUT /profile", updateProfileHandler)
 
 	// Health endpoint so external checks (and our own check) succeed
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
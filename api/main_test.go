@@ -1,3 +1,457 @@
 package main
 
 //yeah idk how to write tests but i pretend that I
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	oauth2 "github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/gorilla/websocket"
+)
+
+// openTestDB points the package's db at a fresh database built from schema.sql, with one pet
+// co-owned by two users, and returns the pet and owner IDs.
+func openTestDB(t *testing.T, money int) (petID, owner1, owner2 int) {
+	t.Helper()
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "game.db")+databaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+
+	for i, name := range []string{"alice", "bob"} {
+		res, err := db.Exec("INSERT INTO users (username, password) VALUES (?, 'x')", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		if i == 0 {
+			owner1 = int(id)
+		} else {
+			owner2 = int(id)
+		}
+	}
+	res, err := db.Exec("INSERT INTO pets (main_owner, owner2, money, health, hunger, happiness) VALUES (?, ?, ?, 100, 100, 100)", owner1, owner2, money)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	if _, err := db.Exec("UPDATE users SET pet_id = ? WHERE id = ?", id, owner1); err != nil {
+		t.Fatal(err)
+	}
+	return int(id), owner1, owner2
+}
+
+var (
+	testOAuthOnce    sync.Once
+	testOAuthManager *manage.Manager
+)
+
+// testToken returns a bearer token for a user, setting up an in-memory OAuth2 server the
+// first time it is called.
+func testToken(t *testing.T, userID int) string {
+	t.Helper()
+	testOAuthOnce.Do(func() {
+		testOAuthManager = initOAuth2Manager("test_client", "test_secret")
+		oauth2Server = initOAuth2Server(testOAuthManager)
+	})
+	ti, err := testOAuthManager.GenerateAccessToken(context.Background(), oauth2.PasswordCredentials,
+		&oauth2.TokenGenerateRequest{ClientID: "test_client", ClientSecret: "test_secret", UserID: strconv.Itoa(userID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti.GetAccess()
+}
+
+// adopt calls POST /create_pet as a user and returns the status code.
+func adopt(t *testing.T, userID int, species string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/create_pet", strings.NewReader(fmt.Sprintf(`{"species": %q}`, species)))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, userID))
+	rec := httptest.NewRecorder()
+	createPetHandler(rec, req)
+	return rec.Code
+}
+
+// petMoneyAndLedger returns a pet's balance and the number and sum of its ledger entries.
+func petMoneyAndLedger(t *testing.T, petID int) (money, entries, total int) {
+	t.Helper()
+	if err := db.QueryRow("SELECT money FROM pets WHERE id = ?", petID).Scan(&money); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transactions WHERE pet_id = ?", petID).Scan(&entries, &total); err != nil {
+		t.Fatal(err)
+	}
+	return money, entries, total
+}
+
+// spendOp spends one coin of a pet's money as one of its owners, under an idempotency key.
+// It reports whether the spend went through.
+type spendOp func(owner int, key string) (bool, error)
+
+// economyTestServer serves Purchase, Gift and Reward over a WebSocket, the way /ws dispatches
+// them. The caller's user ID is the "user" query parameter.
+func economyTestServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg struct {
+				Type string `json:"type"`
+			}
+			_ = json.Unmarshal(message, &msg)
+			switch strings.ToLower(msg.Type) {
+			case opPurchase:
+				handlePurchase(conn, userID, message)
+			case opGift:
+				handleGift(conn, userID, message)
+			case opReward:
+				handleReward(conn, userID, message)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// sendEconomyOp sends one message as a user on a new connection and returns the reply.
+func sendEconomyOp(url string, userID int, msg map[string]interface{}) (map[string]interface{}, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?user=%d", url, userID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(msg); err != nil {
+		return nil, err
+	}
+	var reply map[string]interface{}
+	err = conn.ReadJSON(&reply)
+	return reply, err
+}
+
+// economyOpResult turns a Purchase or Gift reply into whether it went through. Only running
+// out of money is an expected failure.
+func economyOpResult(reply map[string]interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case reply["status"] == "success":
+		return true, nil
+	case reply["status"] == "fail" && strings.HasPrefix(fmt.Sprint(reply["message"]), "Insufficient funds"):
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected reply %v", reply)
+}
+
+// spendOps returns the ways a pet's owners can spend one coin: the legacy PetMoneyUpdate,
+// buying a one-coin item with Purchase, and a one-coin Gift to a friend's pet. It adds the
+// item, the friend and the friend's pet to the test database.
+func spendOps(t *testing.T, petID, owner1, owner2 int) map[string]spendOp {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO items (id, display_name, label, effect, magnitude, price, stack_limit)
+		VALUES ('pebble', 'Pebble', 'a pebble', 'happiness', 1, 1, 1000)`); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO users (username, password) VALUES ('carol', 'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	carol := int(id)
+	if _, err := db.Exec("INSERT INTO pets (main_owner, money, health, hunger, happiness) VALUES (?, 0, 100, 100, 100)", carol); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET pet_id = (SELECT id FROM pets WHERE main_owner = ?) WHERE id = ?", carol, carol); err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range []int{owner1, owner2} {
+		if _, err := db.Exec("INSERT INTO friendships (requester_id, addressee_id, status, created_at) VALUES (?, ?, 'accepted', ?)",
+			owner, carol, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	url := economyTestServer(t)
+	return map[string]spendOp{
+		"PetMoneyUpdate": func(owner int, key string) (bool, error) {
+			ok, _, err := validateAndUpdatePetMoney(petID, owner, 1, key)
+			return ok, err
+		},
+		"Purchase": func(owner int, key string) (bool, error) {
+			return economyOpResult(sendEconomyOp(url, owner, map[string]interface{}{"type": "Purchase", "item": "pebble", "idempotency_key": key}))
+		},
+		"Gift": func(owner int, key string) (bool, error) {
+			return economyOpResult(sendEconomyOp(url, owner, map[string]interface{}{"type": "Gift", "user": "carol", "amount": 1, "idempotency_key": key}))
+		},
+	}
+}
+
+// TestConcurrentSpendFromBothOwners has both owners spend a pet's money at once. Every coin
+// must be spent exactly once, with one ledger entry per successful spend.
+func TestConcurrentSpendFromBothOwners(t *testing.T) {
+	const perOwner = 50
+	for _, name := range []string{"PetMoneyUpdate", "Purchase", "Gift"} {
+		t.Run(name, func(t *testing.T) {
+			petID, owner1, owner2 := openTestDB(t, 2*perOwner)
+			spend := spendOps(t, petID, owner1, owner2)[name]
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			successes, failures := 0, 0
+			for i := 0; i < perOwner; i++ {
+				for _, owner := range []int{owner1, owner2} {
+					wg.Add(1)
+					go func(owner, i int) {
+						defer wg.Done()
+						ok, err := spend(owner, fmt.Sprintf("spend-%d", i))
+						mu.Lock()
+						defer mu.Unlock()
+						if err != nil {
+							t.Errorf("spend failed: %v", err)
+						} else if ok {
+							successes++
+						} else {
+							failures++
+						}
+					}(owner, i)
+				}
+			}
+			wg.Wait()
+
+			money, entries, total := petMoneyAndLedger(t, petID)
+			if successes != 2*perOwner || failures != 0 {
+				t.Errorf("got %d successes and %d failures, want %d and 0", successes, failures, 2*perOwner)
+			}
+			if money != 0 {
+				t.Errorf("money = %d, want 0", money)
+			}
+			if entries != 2*perOwner || total != -2*perOwner {
+				t.Errorf("ledger has %d entries summing to %d, want %d summing to %d", entries, total, 2*perOwner, -2*perOwner)
+			}
+		})
+	}
+}
+
+// TestConcurrentSpendCannotOverdraw has both owners try to spend more than the pet has.
+func TestConcurrentSpendCannotOverdraw(t *testing.T) {
+	const money, attempts = 10, 40
+	for _, name := range []string{"PetMoneyUpdate", "Purchase", "Gift"} {
+		t.Run(name, func(t *testing.T) {
+			petID, owner1, owner2 := openTestDB(t, money)
+			spend := spendOps(t, petID, owner1, owner2)[name]
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			successes := 0
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					owner := owner1
+					if i%2 == 1 {
+						owner = owner2
+					}
+					ok, err := spend(owner, fmt.Sprintf("overdraw-%d", i))
+					if err != nil {
+						t.Errorf("spend failed: %v", err)
+						return
+					}
+					if ok {
+						mu.Lock()
+						successes++
+						mu.Unlock()
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			left, entries, _ := petMoneyAndLedger(t, petID)
+			if successes != money || left != 0 || entries != money {
+				t.Errorf("got %d successes, %d left and %d ledger entries, want %d, 0 and %d", successes, left, entries, money, money)
+			}
+		})
+	}
+}
+
+// TestDuplicateIdempotencyKeyChargesOnce sends the same PetMoneyUpdate many times at once.
+// Only one may charge the pet; the others must be told they are duplicates.
+func TestDuplicateIdempotencyKeyChargesOnce(t *testing.T) {
+	const attempts = 20
+	petID, owner1, _ := openTestDB(t, 100)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	charged, duplicates := 0, 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, _, err := validateAndUpdatePetMoney(petID, owner1, 5, "same-key")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == errDuplicateRequest:
+				duplicates++
+			case err != nil:
+				t.Errorf("spend failed: %v", err)
+			case ok:
+				charged++
+			}
+		}()
+	}
+	wg.Wait()
+
+	money, entries, _ := petMoneyAndLedger(t, petID)
+	if charged != 1 || duplicates != attempts-1 {
+		t.Errorf("got %d charges and %d duplicates, want 1 and %d", charged, duplicates, attempts-1)
+	}
+	if money != 95 || entries != 1 {
+		t.Errorf("money = %d with %d ledger entries, want 95 and 1", money, entries)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT response FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", owner1, "same-key").Scan(&stored); err != nil {
+		t.Fatalf("no stored response: %v", err)
+	}
+	if want := `{"newMoney":95,"status":"success","type":"ResultResponse"}`; stored != want {
+		t.Errorf("stored response = %s, want %s", stored, want)
+	}
+}
+
+// TestDuplicateEconomyMessageAppliesOnce sends the same Purchase, Gift or Reward many times
+// at once. The pet's money must change once, and every reply must be the stored response.
+func TestDuplicateEconomyMessageAppliesOnce(t *testing.T) {
+	const attempts = 20
+	tests := []struct {
+		msg    map[string]interface{}
+		change int
+	}{
+		{map[string]interface{}{"type": "Purchase", "item": "pebble", "quantity": 5}, -5},
+		{map[string]interface{}{"type": "Gift", "user": "carol", "amount": 5}, -5},
+		{map[string]interface{}{"type": "Reward", "source": "daily"}, rewardSources["daily"].Coins},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg["type"].(string), func(t *testing.T) {
+			petID, owner1, owner2 := openTestDB(t, 100)
+			spendOps(t, petID, owner1, owner2)
+			url := economyTestServer(t)
+			tt.msg["idempotency_key"] = "same-key"
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var replies []string
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					reply, err := sendEconomyOp(url, owner1, tt.msg)
+					mu.Lock()
+					defer mu.Unlock()
+					if err != nil {
+						t.Errorf("send failed: %v", err)
+						return
+					}
+					if reply["status"] != "success" {
+						t.Errorf("unexpected reply %v", reply)
+					}
+					replies = append(replies, fmt.Sprint(reply))
+				}()
+			}
+			wg.Wait()
+
+			money, entries, total := petMoneyAndLedger(t, petID)
+			if money != 100+tt.change || entries != 1 || total != tt.change {
+				t.Errorf("money = %d with %d ledger entries summing to %d, want %d, 1 and %d", money, entries, total, 100+tt.change, tt.change)
+			}
+			for _, r := range replies {
+				if r != replies[0] {
+					t.Errorf("replies differ: %s and %s", r, replies[0])
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestAdoptionRefusals covers who may adopt: not a user who cannot afford the species, and not
+// an owner or co-owner of a living pet. Once the pet has passed away, its owner may adopt again.
+func TestAdoptionRefusals(t *testing.T) {
+	petID, owner1, owner2 := openTestDB(t, 0)
+	res, err := db.Exec("INSERT INTO users (username, password, coins) VALUES ('carol', 'x', 5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	carol := int(id)
+
+	if code := adopt(t, carol, "blue_motchi"); code != http.StatusPaymentRequired {
+		t.Errorf("adopting without enough coins: status %d, want %d", code, http.StatusPaymentRequired)
+	}
+	for _, owner := range []int{owner1, owner2} {
+		if code := adopt(t, owner, "pink_motchi"); code != http.StatusConflict {
+			t.Errorf("adopting with a living pet: status %d, want %d", code, http.StatusConflict)
+		}
+	}
+	var coins int
+	if err := db.QueryRow("SELECT coins FROM users WHERE id = ?", owner1).Scan(&coins); err != nil {
+		t.Fatal(err)
+	}
+	if coins != 20 {
+		t.Errorf("refused adoption charged the owner: %d coins left, want 20", coins)
+	}
+
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE pets SET state = ? WHERE id = ?", statePassedAway, petID); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivePetTx(tx, pet, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if code := adopt(t, owner1, "cactee"); code != http.StatusCreated {
+		t.Errorf("adopting after the pet passed away: status %d, want %d", code, http.StatusCreated)
+	}
+}
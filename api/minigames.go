@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// minigameRules describes how the server judges a completed round of a minigame.
+type minigameRules struct {
+	Duration        time.Duration // length of a full round
+	MaxScore        int
+	PointsPerSecond float64             // the fastest a score can grow
+	SubmitWindow    time.Duration       // how long after a full round a result is still accepted
+	Coins           func(score int) int // coins earned for a score, before the daily cap
+	XP              func(score int) int // pet XP earned for a score
+
+	// Replay, when set, re-runs a round from its seed and input log and returns the score
+	// and duration the round really had. Results of such games must include their inputs.
+	Replay func(seed int64, inputs []minigameInput) (int, time.Duration, error)
+}
+
+// minigames are the games that can be played for coins, keyed by the {game} path value.
+var minigames = map[string]minigameRules{
+	// dodge is DodgeFall: survive 15 seconds of falling blocks. The score is the number of
+	// whole seconds survived; surviving the full round pays the 3 coins the client used to
+	// award itself. Results are verified by replaying the inputs; see dodge.go.
+	"dodge": {
+		Duration:        15 * time.Second,
+		MaxScore:        15,
+		PointsPerSecond: 1,
+		SubmitWindow:    2 * time.Minute,
+		Coins: func(score int) int {
+			if score >= 15 {
+				return 3
+			}
+			return score / 5
+		},
+		XP:     func(score int) int { return score / 3 },
+		Replay: replayDodge,
+	},
+}
+
+const (
+	// maxMinigameCoinsPerDay caps the coins a user can earn from minigames per UTC day.
+	maxMinigameCoinsPerDay = 30
+	// minigameClockSkew is how much longer a client may claim to have played than the server
+	// saw pass, to absorb network latency.
+	minigameClockSkew = 2 * time.Second
+)
+
+// minigameSession is one row of minigame_sessions.
+type minigameSession struct {
+	ID          string
+	Game        string
+	UserID      int
+	PetID       int
+	Seed        int64
+	StartedAt   time.Time
+	ExpiresAt   time.Time
+	CompletedAt sql.NullTime
+}
+
+// newSessionID returns a random 128-bit session id, hex-encoded.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSeed returns a random non-negative seed that fits in a JavaScript number.
+func newSeed() (int64, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint32(b) >> 1), nil
+}
+
+// loadMinigameSession reads a session by id.
+// Returns:
+// - The session.
+// - sql.ErrNoRows if it does not exist, or another error if the query fails.
+func loadMinigameSession(q sqlExecutor, id string) (*minigameSession, error) {
+	s := &minigameSession{}
+	err := q.QueryRow("SELECT id, game, user_id, pet_id, seed, started_at, expires_at, completed_at FROM minigame_sessions WHERE id = ?", id).
+		Scan(&s.ID, &s.Game, &s.UserID, &s.PetID, &s.Seed, &s.StartedAt, &s.ExpiresAt, &s.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// minigameCoinsToday returns the coins a user has earned from minigames since the start of
+// the current UTC day.
+func minigameCoinsToday(q sqlExecutor, userID int, now time.Time) (int, error) {
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var coins int
+	err := q.QueryRow("SELECT COALESCE(SUM(coins), 0) FROM minigame_sessions WHERE user_id = ? AND completed_at >= ?", userID, dayStart).Scan(&coins)
+	return coins, err
+}
+
+// startMinigameHandler issues a session for a round of a minigame.
+// Endpoint: POST /minigames/{game}/sessions
+// Response:
+// - 201 Created with the session id, the seed for the round, its duration and when results stop being accepted.
+// - 401 Unauthorized if the user is not authenticated.
+// - 404 Not Found if the game does not exist or the caller has no pet.
+// - 409 Conflict if the caller's pet has fainted.
+func startMinigameHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	game := r.PathValue("game")
+	rules, known := minigames[game]
+	if !known {
+		http.Error(w, "Unknown game", http.StatusNotFound)
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Caller has no pet", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if pet.State == stateFainted || pet.State == statePassedAway {
+		http.Error(w, fmt.Sprintf("%s cannot play while %s", pet.Name, pet.State), http.StatusConflict)
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, "Error starting session", http.StatusInternalServerError)
+		return
+	}
+	seed, err := newSeed()
+	if err != nil {
+		http.Error(w, "Error starting session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	expires := now.Add(rules.Duration + rules.SubmitWindow)
+	if _, err := db.Exec("INSERT INTO minigame_sessions (id, game, user_id, pet_id, seed, started_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, game, userID, petID, seed, now, expires); err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error starting session", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("minigame_started", map[string]interface{}{"user_id": userID, "pet_id": petID, "game": game, "session_id": id})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"session_id":       id,
+		"game":             game,
+		"seed":             seed,
+		"duration_seconds": int(rules.Duration.Seconds()),
+		"started_at":       now,
+		"expires_at":       expires,
+	})
+}
+
+// completeMinigameHandler judges a finished round and credits the caller's pet.
+// Endpoint: POST /minigames/{game}/sessions/{id}/complete
+// Request Body:
+// - score: The score the client reports.
+// - duration_ms: How long the round lasted, in milliseconds. Ignored for replayed games.
+// - inputs: The input log, required by games that verify results by replay.
+// Response:
+// - 200 OK with the coins and XP awarded and the pet's new money.
+// - 400 Bad Request if the body is invalid, the result breaks the game's rules, or the replay does not match the score.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the session belongs to someone else.
+// - 404 Not Found if the session does not exist.
+// - 409 Conflict if the session was already completed, or the pet fainted or passed away during the round.
+// - 410 Gone if the result arrives after the session expired.
+func completeMinigameHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	game := r.PathValue("game")
+	rules, known := minigames[game]
+	if !known {
+		http.Error(w, "Unknown game", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Score      *int             `json:"score"`
+		DurationMS int              `json:"duration_ms"`
+		Inputs     *[]minigameInput `json:"inputs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Score == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	session, err := loadMinigameSession(db, r.PathValue("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading session", http.StatusInternalServerError)
+		return
+	}
+	if session.Game != game {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if session.UserID != userID {
+		http.Error(w, "This session belongs to another user", http.StatusForbidden)
+		return
+	}
+	if session.CompletedAt.Valid {
+		http.Error(w, "Session already completed", http.StatusConflict)
+		return
+	}
+	now := time.Now().UTC()
+	if now.After(session.ExpiresAt) {
+		http.Error(w, "Session expired", http.StatusGone)
+		return
+	}
+
+	// The claimed round must fit the game's rules and the time the server saw pass.
+	duration := time.Duration(req.DurationMS) * time.Millisecond
+	score := *req.Score
+	if rules.Replay != nil {
+		if req.Inputs == nil {
+			http.Error(w, "inputs are required for "+game, http.StatusBadRequest)
+			return
+		}
+		replayScore, replayDuration, err := rules.Replay(session.Seed, *req.Inputs)
+		if err != nil {
+			http.Error(w, "Invalid inputs: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if replayScore != score {
+			logMessage("minigame_replay_mismatch", map[string]interface{}{"user_id": userID, "session_id": session.ID, "score": score, "replay_score": replayScore})
+			http.Error(w, fmt.Sprintf("score does not match the replay, which scored %d", replayScore), http.StatusBadRequest)
+			return
+		}
+		duration = replayDuration
+	}
+	switch {
+	case duration < 0 || duration > rules.Duration:
+		http.Error(w, fmt.Sprintf("duration_ms must be between 0 and %d", rules.Duration.Milliseconds()), http.StatusBadRequest)
+		return
+	case duration > now.Sub(session.StartedAt)+minigameClockSkew:
+		http.Error(w, "duration_ms is longer than the session has existed", http.StatusBadRequest)
+		return
+	case score < 0 || score > rules.MaxScore:
+		http.Error(w, fmt.Sprintf("score must be between 0 and %d", rules.MaxScore), http.StatusBadRequest)
+		return
+	case float64(score) > duration.Seconds()*rules.PointsPerSecond:
+		http.Error(w, "score is too high for the duration", http.StatusBadRequest)
+		return
+	}
+
+	// Apply pending decay first so the reward lands on the pet's current stats.
+	if _, err := refreshPet(session.PetID); err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": session.PetID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, session.PetID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "You no longer own this pet", http.StatusForbidden)
+		return
+	}
+	// The pet may have fainted or passed away during the round.
+	if pet.State == stateFainted || pet.State == statePassedAway {
+		http.Error(w, fmt.Sprintf("%s cannot be rewarded while %s", pet.Name, pet.State), http.StatusConflict)
+		return
+	}
+	earned, err := minigameCoinsToday(tx, userID, now)
+	if err != nil {
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	coins := rules.Coins(score)
+	capped := false
+	if left := maxMinigameCoinsPerDay - earned; coins > left {
+		coins, capped = max(left, 0), true
+	}
+	xp := rules.XP(score)
+
+	// completed_at IS NULL makes a concurrent duplicate submission lose here.
+	res, err := tx.Exec("UPDATE minigame_sessions SET completed_at = ?, score = ?, coins = ?, xp = ? WHERE id = ? AND completed_at IS NULL",
+		now, score, coins, xp, session.ID)
+	if err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "session_id": session.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Session already completed", http.StatusConflict)
+		return
+	}
+	if _, err := tx.Exec("UPDATE pets SET money = money + ? WHERE id = ?", coins, pet.ID); err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	pet.Money += coins
+	if coins > 0 {
+		if _, err := recordTransaction(tx, pet.ID, userID, coins, txReasonMinigameReward, session.ID); err != nil {
+			logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+			http.Error(w, "Error completing session", http.StatusInternalServerError)
+			return
+		}
+		if err := recordLeaderboardScore(tx, "coins_earned", pet.ID, coins); err != nil {
+			logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+			http.Error(w, "Error completing session", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Only replay-verified scores are trusted on the leaderboard.
+	if rules.Replay != nil {
+		if err := recordLeaderboardScore(tx, "minigame_high_score", userID, score); err != nil {
+			logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+			http.Error(w, "Error completing session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	entry, err := recordActivity(tx, pet.ID, userID, activityMinigame,
+		fmt.Sprintf("%s scored %d in %s and earned %d coins", userDisplayName(tx, userID), score, game, coins),
+		map[string]interface{}{"game": game, "score": score, "coins": coins, "xp": xp})
+	if err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	vacation, vacationEntry, err := endVacationTx(tx, pet, userID, vacationEndedOnInteract, now)
+	if err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	progress, err := awardXPTx(tx, pet, xp, userID)
+	if err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	previousMood, moodChanged, err := updateMoodTx(tx, pet, now)
+	if err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	if err := recordStatSample(tx, pet, now); err != nil {
+		logMessage("minigame_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error completing session", http.StatusInternalServerError)
+		return
+	}
+
+	publishPetStats(pet)
+	publishActivity(entry)
+	publishVacationEnded(pet, vacation, vacationEntry)
+	publishProgress(pet, progress)
+	if moodChanged {
+		publishMood(pet, previousMood)
+	}
+	logMessage("minigame_completed", map[string]interface{}{"user_id": userID, "pet_id": pet.ID, "game": game, "score": score, "coins": coins, "capped": capped})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"session_id":       session.ID,
+		"score":            score,
+		"coins":            coins,
+		"capped":           capped,
+		"daily_coins_left": maxMinigameCoinsPerDay - earned - coins,
+		"xp":               xp,
+		"money":            pet.Money,
+		"level":            pet.Level,
+	})
+}
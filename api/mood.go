@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Moods a pet can be in. Clients pick art by mood, so the set is part of the API.
+const (
+	moodDeparted    = "departed"
+	moodUnconscious = "unconscious"
+	moodSick        = "sick"
+	moodHungry      = "hungry"
+	moodSad         = "sad"
+	moodLonely      = "lonely"
+	moodSleeping    = "sleeping"
+	moodExcited     = "excited"
+	moodHappy       = "happy"
+	moodContent     = "content"
+)
+
+// Mood timing: a pet nobody has interacted with for lonelyAfter gets lonely, and one
+// cared for within excitedWithin of a good mood gets excited.
+const (
+	lonelyAfter   = 12 * time.Hour
+	excitedWithin = 30 * time.Minute
+)
+
+// petMood derives a pet's mood. Rules are checked in order and the first match wins:
+// lifecycle and stats first, then sleep, then recent interactions.
+// Parameters:
+// - p: The pet, with up-to-date stats, state and Asleep flag.
+// - lastInteraction: When an owner last interacted with the pet (zero if never).
+// - now: The current time.
+// Returns:
+// - One of the mood* constants.
+func petMood(p *petRecord, lastInteraction time.Time, now time.Time) string {
+	switch {
+	case p.State == statePassedAway:
+		return moodDeparted
+	case p.State == stateFainted:
+		return moodUnconscious
+	case p.State == stateSick || p.State == stateCritical || p.Health < 30:
+		return moodSick
+	case p.Hunger < 30:
+		return moodHungry
+	case p.Happiness < 30:
+		return moodSad
+	case p.Asleep:
+		return moodSleeping
+	case lastInteraction.IsZero() || now.Sub(lastInteraction) >= lonelyAfter:
+		return moodLonely
+	case now.Sub(lastInteraction) < excitedWithin && p.Happiness >= 80:
+		return moodExcited
+	case p.Happiness >= 80 && p.Hunger >= 60 && p.Health >= 60:
+		return moodHappy
+	default:
+		return moodContent
+	}
+}
+
+// lastInteractionAt returns when an owner last did something with a pet, taken from the
+// newest activity entry that has an actor.
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// Returns:
+// - The time, or the zero time if no owner has interacted with the pet.
+// - An error if the query fails.
+func lastInteractionAt(q sqlExecutor, petID int) (time.Time, error) {
+	var at time.Time
+	err := q.QueryRow("SELECT created_at FROM pet_activity WHERE pet_id = ? AND actor_id IS NOT NULL ORDER BY id DESC LIMIT 1", petID).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return at, err
+}
+
+// updateMoodTx works out whether a pet is asleep, recomputes its mood and stores the mood
+// if it changed.
+// Parameters:
+// - tx: The transaction to run in.
+// - p: The pet; its Asleep and Mood are updated.
+// - now: The current time.
+// Returns:
+// - The previous mood.
+// - A boolean indicating if the mood changed.
+// - An error if a query fails.
+func updateMoodTx(tx *sql.Tx, p *petRecord, now time.Time) (string, bool, error) {
+	previous := p.Mood
+	asleep, err := petAsleep(tx, p, now)
+	if err != nil {
+		return previous, false, err
+	}
+	p.Asleep = asleep
+	last, err := lastInteractionAt(tx, p.ID)
+	if err != nil {
+		return previous, false, err
+	}
+	mood := petMood(p, last, now)
+	if mood == previous {
+		return previous, false, nil
+	}
+	if _, err := tx.Exec("UPDATE pets SET mood = ? WHERE id = ?", mood, p.ID); err != nil {
+		return previous, false, err
+	}
+	p.Mood = mood
+	return previous, true, nil
+}
+
+// publishMood pushes a MoodChanged event to every connected owner.
+// Parameters:
+// - p: The pet, already in its new mood.
+// - previous: The mood it left.
+func publishMood(p *petRecord, previous string) {
+	sendToOwners(p, moodMessage(p, previous))
+}
+
+// moodMessage builds the MoodChanged message for a pet.
+func moodMessage(p *petRecord, previous string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":          "MoodChanged",
+		"pet_id":        p.ID,
+		"mood":          p.Mood,
+		"previous_mood": previous,
+	}
+}
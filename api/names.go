@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Pet name length limits, in characters.
+const (
+	minPetNameLength = 1
+	maxPetNameLength = 20
+)
+
+// blockedNameWords are rejected anywhere in a pet name as whole words, or as the whole
+// name once spaces and punctuation are removed.
+var blockedNameWords = []string{
+	"ass", "asshole", "bastard", "bitch", "bollocks", "crap", "cunt", "damn", "dick",
+	"fuck", "fucker", "piss", "prick", "shit", "slut", "twat", "wanker", "whore",
+}
+
+// leetReplacer undoes common character substitutions before the profanity check.
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+// validatePetName checks a proposed pet name and returns it normalized.
+// Names are trimmed, must be 1-20 characters long, may only contain letters, digits,
+// spaces, hyphens and apostrophes, and must pass the profanity filter.
+// Parameters:
+// - name: The proposed name.
+// Returns:
+// - The normalized name (trimmed, inner whitespace collapsed).
+// - An error describing why the name was rejected.
+func validatePetName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	length := len([]rune(name))
+	if length < minPetNameLength || length > maxPetNameLength {
+		return "", fmt.Errorf("name must be between %d and %d characters", minPetNameLength, maxPetNameLength)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && r != '-' && r != '\'' {
+			return "", errors.New("name may only contain letters, digits, spaces, hyphens and apostrophes")
+		}
+	}
+	if containsProfanity(name) {
+		return "", errors.New("name is not allowed")
+	}
+	return name, nil
+}
+
+// containsProfanity reports whether a name contains a blocked word.
+func containsProfanity(name string) bool {
+	normalized := leetReplacer.Replace(strings.ToLower(name))
+	words := strings.FieldsFunc(normalized, func(r rune) bool { return r == ' ' || r == '-' || r == '\'' })
+	collapsed := strings.Join(words, "")
+	for _, blocked := range blockedNameWords {
+		if collapsed == blocked {
+			return true
+		}
+		for _, w := range words {
+			if w == blocked {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renamePetHandler renames a pet and records the change in its activity feed.
+// Endpoint: PUT /pets/{id}/name
+// Request Body:
+// - name: The new name (see validatePetName).
+// Response:
+// - 200 OK with the pet's id and new name.
+// - 400 Bad Request if the body is invalid or the name is not allowed.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func renamePetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, err := validatePetName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error renaming pet", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can rename a pet", http.StatusForbidden)
+		return
+	}
+	if pet.Name == name {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": petID, "name": name})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE pets SET name = ? WHERE id = ?", name, petID); err != nil {
+		logMessage("rename_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error renaming pet", http.StatusInternalServerError)
+		return
+	}
+	// The activity entry doubles as the audit record of who renamed the pet and from what.
+	entry, err := recordActivity(tx, petID, userID, activityPetRenamed,
+		fmt.Sprintf("%s renamed %s to %s", userDisplayName(tx, userID), pet.Name, name),
+		map[string]interface{}{"old_name": pet.Name, "new_name": name})
+	if err != nil {
+		logMessage("rename_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error renaming pet", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error renaming pet", http.StatusInternalServerError)
+		return
+	}
+	publishActivity(entry)
+
+	logMessage("rename_pet", map[string]interface{}{"pet_id": petID, "user_id": userID, "old_name": pet.Name, "new_name": name})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": petID, "name": name})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx so helpers can run
+// either standalone or as part of a larger transaction.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Pet visibility settings controlling who may visit a pet through GET /pets/{id}.
+const (
+	visibilityPrivate = "private"
+	visibilityFriends = "friends"
+	visibilityPublic  = "public"
+)
+
+// petRecord is a row of the pets table.
+type petRecord struct {
+	ID         int
+	Name       string
+	MainOwner  int
+	Owner2     sql.NullInt64
+	Money      int
+	Health     int
+	Hunger     int
+	Happiness  int
+	Species    string
+	Visibility string
+	State      string
+	StateSince sql.NullTime
+	XP         int
+	Level      int
+	Stage      string
+	Mood       string
+	Asleep     bool         // derived from the owners' sleep schedules; not a column
+	Vacation   *petVacation // the active vacation, if any; not a column
+}
+
+// loadPet reads a pet row.
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// Returns:
+// - The pet record.
+// - sql.ErrNoRows if the pet does not exist, or another error if the query fails.
+func loadPet(q sqlExecutor, petID int) (*petRecord, error) {
+	var p petRecord
+	err := q.QueryRow("SELECT id, name, main_owner, owner2, money, health, hunger, happiness, species, visibility, state, state_since, xp, level, stage, mood FROM pets WHERE id = ?", petID).
+		Scan(&p.ID, &p.Name, &p.MainOwner, &p.Owner2, &p.Money, &p.Health, &p.Hunger, &p.Happiness, &p.Species, &p.Visibility, &p.State, &p.StateSince,
+			&p.XP, &p.Level, &p.Stage, &p.Mood)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// isOwner reports whether the user is the main owner or co-owner of the pet.
+func (p *petRecord) isOwner(userID int) bool {
+	return p.MainOwner == userID || (p.Owner2.Valid && int(p.Owner2.Int64) == userID)
+}
+
+// ownerIDs returns the IDs of every owner of the pet.
+func (p *petRecord) ownerIDs() []int {
+	ids := []int{p.MainOwner}
+	if p.Owner2.Valid {
+		ids = append(ids, int(p.Owner2.Int64))
+	}
+	return ids
+}
+
+// visiblePetsQuery returns a query for the IDs of the living pets a user may visit, applying
+// the same rules as canVisitPet, for filtering lists in SQL.
+// Parameters:
+// - viewerID: The ID of the viewing user.
+// Returns:
+// - The query and its arguments.
+func visiblePetsQuery(viewerID int) (string, []interface{}) {
+	query := `SELECT p.id FROM pets p WHERE p.state != ? AND (p.main_owner = ? OR p.owner2 = ? OR (
+		NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.blocker_id = ? AND b.blocked_id IN (p.main_owner, p.owner2))
+			OR (b.blocked_id = ? AND b.blocker_id IN (p.main_owner, p.owner2)))
+		AND (p.visibility = ? OR (p.visibility = ? AND EXISTS (SELECT 1 FROM friendships f WHERE f.status = 'accepted'
+			AND ((f.requester_id = ? AND f.addressee_id IN (p.main_owner, p.owner2)) OR (f.addressee_id = ? AND f.requester_id IN (p.main_owner, p.owner2))))))))`
+	args := []interface{}{statePassedAway, viewerID, viewerID, viewerID, viewerID, visibilityPublic, visibilityFriends, viewerID, viewerID}
+	return query, args
+}
+
+// canVisitPet reports whether a user may view a pet they do not necessarily own.
+// Owners can always see their pet. Anyone who is blocked by, or has blocked, an owner
+// cannot. Otherwise the pet's visibility decides: public pets are open to everyone,
+// friends-only pets to friends of either owner, and private pets to owners only.
+// Parameters:
+// - p: The pet being visited.
+// - viewerID: The ID of the visiting user.
+// Returns:
+// - A boolean indicating if the visit is allowed.
+// - An error if a lookup fails.
+func canVisitPet(p *petRecord, viewerID int) (bool, error) {
+	if p.isOwner(viewerID) {
+		return true, nil
+	}
+	for _, ownerID := range p.ownerIDs() {
+		blocked, err := isBlockedBetween(viewerID, ownerID)
+		if err != nil {
+			return false, err
+		}
+		if blocked {
+			return false, nil
+		}
+	}
+	switch p.Visibility {
+	case visibilityPublic:
+		return true, nil
+	case visibilityFriends:
+		for _, ownerID := range p.ownerIDs() {
+			friends, err := areFriends(viewerID, ownerID)
+			if err != nil {
+				return false, err
+			}
+			if friends {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// petIDFromPath parses the {id} path value of a /pets/{id}/... route.
+// Returns:
+// - The pet ID and true, or false after writing a 400 response.
+func petIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	petID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid pet id", http.StatusBadRequest)
+		return 0, false
+	}
+	return petID, true
+}
+
+// visitPetHandler returns a read-only view of a pet.
+// Endpoint: GET /pets/{id}
+// Response:
+// - 200 OK with the pet's name, stats, species, lifecycle state, level, stage and mood. Owners additionally see money and visibility.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the pet's privacy setting does not allow the caller to visit.
+// - 404 Not Found if the pet does not exist.
+func visitPetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	// Check access on the stored pet first, so callers who may not visit cannot trigger decay writes.
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		logMessage("visit_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := canVisitPet(pet, userID)
+	if err != nil {
+		logMessage("visit_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "user_id": userID})
+		http.Error(w, "Error checking pet access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You are not allowed to visit this pet", http.StatusForbidden)
+		return
+	}
+
+	if pet, err = refreshPet(petID); err != nil {
+		logMessage("visit_pet_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"id":         pet.ID,
+		"name":       pet.Name,
+		"species":    pet.Species,
+		"state":      pet.State,
+		"level":      pet.Level,
+		"stage":      pet.Stage,
+		"mood":       pet.Mood,
+		"sleeping":   pet.Asleep,
+		"health":     pet.Health,
+		"hunger":     pet.Hunger,
+		"happiness":  pet.Happiness,
+		"main_owner": pet.MainOwner,
+		"owner2":     nil,
+	}
+	if pet.Owner2.Valid {
+		resp["owner2"] = int(pet.Owner2.Int64)
+	}
+	if pet.isOwner(userID) {
+		resp["money"] = pet.Money
+		resp["visibility"] = pet.Visibility
+	}
+
+	logMessage("visit_pet", map[string]interface{}{"pet_id": petID, "user_id": userID})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// setPetPrivacyHandler changes who may visit a pet.
+// Endpoint: PUT /pets/{id}/privacy
+// Request Body:
+// - visibility: One of "private", "friends" or "public".
+// Response:
+// - 200 OK on success.
+// - 400 Bad Request if the request body is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func setPetPrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch req.Visibility {
+	case visibilityPrivate, visibilityFriends, visibilityPublic:
+	default:
+		http.Error(w, "visibility must be one of private, friends or public", http.StatusBadRequest)
+		return
+	}
+
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can change a pet's privacy", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE pets SET visibility = ? WHERE id = ?", req.Visibility, petID); err != nil {
+		logMessage("set_pet_privacy_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error updating privacy", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("set_pet_privacy", map[string]interface{}{"pet_id": petID, "user_id": userID, "visibility": req.Visibility})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Privacy updated successfully"))
+}
+
+// getUserPetID returns the pet a user owns, either as main owner (users.pet_id) or as owner2.
+// Pets that have passed away no longer count.
+// Parameters:
+// - userID: The ID of the user.
+// Returns:
+// - The ID of the user's pet.
+// - sql.ErrNoRows if the user has no pet, or another error if the query fails.
+func getUserPetID(userID int) (int, error) {
+	var petID sql.NullInt64
+	if err := db.QueryRow("SELECT pet_id FROM users WHERE id = ?", userID).Scan(&petID); err != nil {
+		return 0, err
+	}
+	if petID.Valid {
+		return int(petID.Int64), nil
+	}
+	var id int
+	err := db.QueryRow("SELECT id FROM pets WHERE owner2 = ? AND state != ?", userID, statePassedAway).Scan(&id)
+	return id, err
+}
+
+// petData builds the "pet" object of a PetDataResponse for one of the pet's owners.
+// Parameters:
+// - p: The pet to describe.
+// Returns:
+// - The JSON-ready pet object.
+func petData(p *petRecord) map[string]interface{} {
+	data := map[string]interface{}{
+		"id":         p.ID,
+		"name":       p.Name,
+		"species":    p.Species,
+		"state":      p.State,
+		"xp":         p.XP,
+		"level":      p.Level,
+		"stage":      p.Stage,
+		"mood":       p.Mood,
+		"sleeping":   p.Asleep,
+		"vacation":   p.Vacation,
+		"money":      p.Money,
+		"health":     p.Health,
+		"hunger":     p.Hunger,
+		"happiness":  p.Happiness,
+		"main_owner": p.MainOwner,
+		"owner2":     nil,
+	}
+	if p.Owner2.Valid {
+		data["owner2"] = int(p.Owner2.Int64)
+	}
+	return data
+}
+
+// handleGetData answers a GetData WebSocket request with the caller's pet and a summary of its inventory.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+func handleGetData(conn *websocket.Conn, userID int) {
+	// Find the user's pet id (server-sourced)
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeConn(conn, map[string]interface{}{
+				"type":    "PetDataResponse",
+				"status":  "fail",
+				"message": "Caller has no pet",
+			})
+			return
+		}
+		logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		writeConn(conn, map[string]interface{}{
+			"type":    "PetDataResponse",
+			"status":  "fail",
+			"message": "Server error retrieving pet data",
+		})
+		return
+	}
+
+	pet, err := refreshPet(petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeConn(conn, map[string]interface{}{
+				"type":    "PetDataResponse",
+				"status":  "fail",
+				"message": "Pet not found",
+			})
+			return
+		}
+		logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		writeConn(conn, map[string]interface{}{
+			"type":    "PetDataResponse",
+			"status":  "fail",
+			"message": "Server error retrieving pet data",
+		})
+		return
+	}
+
+	inventory, err := inventorySummary(db, petID)
+	if err != nil {
+		logMessage("pet_data_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		writeConn(conn, map[string]interface{}{
+			"type":    "PetDataResponse",
+			"status":  "fail",
+			"message": "Server error retrieving pet data",
+		})
+		return
+	}
+	data := petData(pet)
+	data["inventory"] = inventory
+
+	writeConn(conn, map[string]interface{}{
+		"type":   "PetDataResponse",
+		"status": "success",
+		"pet":    data,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// presenceContacts returns the users who should be told when a user comes online or goes
+// offline: their significant other and the other owner of any pet they own.
+// Parameters:
+// - userID: The ID of the user whose presence changed.
+// Returns:
+// - The IDs of the users to notify.
+// - An error if the query fails.
+func presenceContacts(userID int) ([]int, error) {
+	rows, err := db.Query(`SELECT SO FROM users WHERE id = ? AND SO IS NOT NULL
+		UNION SELECT id FROM users WHERE SO = ?
+		UNION SELECT CASE WHEN main_owner = ? THEN owner2 ELSE main_owner END FROM pets
+			WHERE (main_owner = ? AND owner2 IS NOT NULL) OR owner2 = ?`,
+		userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id != userID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// isOnline reports whether a user currently has an open WebSocket connection.
+func isOnline(userID int) bool {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	_, ok := connections[userID]
+	return ok
+}
+
+// markLastSeen records the moment a user's last WebSocket connection closed.
+// Parameters:
+// - userID: The ID of the user.
+func markLastSeen(userID int) {
+	if _, err := db.Exec("UPDATE users SET last_seen = ? WHERE id = ?", time.Now().UTC(), userID); err != nil {
+		logMessage("last_seen_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+	}
+}
+
+// presenceUpdate builds a PresenceUpdate message describing a user.
+// Parameters:
+// - userID: The ID of the user the message is about.
+// - online: Whether the user is currently connected.
+// Returns:
+// - The message, including the user's pet so clients can show what they are playing with.
+// - An error if the user cannot be read.
+func presenceUpdate(userID int, online bool) (map[string]interface{}, error) {
+	var username string
+	var lastSeen sql.NullTime
+	if err := db.QueryRow("SELECT username, last_seen FROM users WHERE id = ?", userID).Scan(&username, &lastSeen); err != nil {
+		return nil, err
+	}
+
+	msg := map[string]interface{}{
+		"type":      "PresenceUpdate",
+		"user_id":   userID,
+		"username":  username,
+		"status":    "offline",
+		"last_seen": nil,
+		"pet_id":    nil,
+		"pet_name":  nil,
+	}
+	if online {
+		msg["status"] = "online"
+	}
+	if lastSeen.Valid {
+		msg["last_seen"] = lastSeen.Time
+	}
+	if petID, err := getUserPetID(userID); err == nil {
+		msg["pet_id"] = petID
+		if pet, err := loadPet(db, petID); err == nil {
+			msg["pet_name"] = pet.Name
+		}
+	}
+	return msg, nil
+}
+
+// broadcastPresence tells a user's partner and co-owners that the user came online or went offline.
+// Parameters:
+// - userID: The ID of the user whose presence changed.
+// - online: Whether the user is now connected.
+func broadcastPresence(userID int, online bool) {
+	contacts, err := presenceContacts(userID)
+	if err != nil {
+		logMessage("presence_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		return
+	}
+	if len(contacts) == 0 {
+		return
+	}
+	msg, err := presenceUpdate(userID, online)
+	if err != nil {
+		logMessage("presence_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		return
+	}
+	for _, contactID := range contacts {
+		sendToUser(contactID, msg)
+	}
+	logMessage("presence_broadcast", map[string]interface{}{"user_id": userID, "status": msg["status"]})
+}
+
+// sendPresenceSnapshot sends a newly connected user the current presence of each of their contacts.
+// Parameters:
+// - userID: The ID of the user who just connected.
+func sendPresenceSnapshot(userID int) {
+	contacts, err := presenceContacts(userID)
+	if err != nil {
+		logMessage("presence_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		return
+	}
+	for _, contactID := range contacts {
+		msg, err := presenceUpdate(contactID, isOnline(contactID))
+		if err != nil {
+			logMessage("presence_error", map[string]interface{}{"error": err.Error(), "user_id": contactID})
+			continue
+		}
+		sendToUser(userID, msg)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// maxLevel is the highest level a pet can reach.
+const maxLevel = 50
+
+// XP awarded for each kind of care. Minigame XP is derived from the score instead.
+var xpRewards = map[string]int{
+	"feed": 5,
+	"play": 8,
+	"heal": 5,
+	"cure": 15,
+}
+
+// levelUnlock is a reward that becomes available when a pet reaches a level.
+type levelUnlock struct {
+	Level int    `json:"level"`
+	Kind  string `json:"kind"` // "cosmetic", "shop_item" or "chest"
+	ID    string `json:"id"`
+}
+
+// levelUnlocks lists every level reward in level order.
+var levelUnlocks = []levelUnlock{
+	{Level: 2, Kind: "cosmetic", ID: "bow"},
+	{Level: 3, Kind: "shop_item", ID: "cake"},
+	{Level: 5, Kind: "cosmetic", ID: "party_hat"},
+	{Level: 8, Kind: "shop_item", ID: "golden_apple"},
+	{Level: 10, Kind: "cosmetic", ID: "sunglasses"},
+	{Level: 15, Kind: "shop_item", ID: "rocket_toy"},
+	{Level: 20, Kind: "cosmetic", ID: "crown"},
+}
+
+// Evolution stages, in order. The level each species reaches a stage at, and the name of
+// its form there, live in the species_forms table.
+const (
+	stageBaby  = "baby"
+	stageChild = "child"
+	stageTeen  = "teen"
+	stageAdult = "adult"
+)
+
+// xpForLevel returns the total XP a pet needs to reach a level: 0 for level 1, then 50,
+// 150, 300, ... so each level costs 50 XP more than the one before.
+func xpForLevel(level int) int {
+	return 25 * level * (level - 1)
+}
+
+// levelForXP returns the level a pet with the given total XP has reached.
+func levelForXP(xp int) int {
+	level := 1
+	for level < maxLevel && xp >= xpForLevel(level+1) {
+		level++
+	}
+	return level
+}
+
+// unlocksBetween returns the rewards unlocked by levels in (from, to].
+func unlocksBetween(from, to int) []levelUnlock {
+	unlocks := []levelUnlock{}
+	for _, u := range levelUnlocks {
+		if u.Level > from && u.Level <= to {
+			unlocks = append(unlocks, u)
+		}
+	}
+	return unlocks
+}
+
+// speciesForm is a species-specific evolution form.
+type speciesForm struct {
+	Stage       string `json:"stage"`
+	DisplayName string `json:"display_name"`
+	MinLevel    int    `json:"min_level"`
+}
+
+// stageForLevel returns the most advanced form a species has reached at a level.
+// Parameters:
+// - q: The database or transaction to read from.
+// - species: The species id.
+// - level: The pet's level.
+// Returns:
+// - The form. Species without forms stay babies.
+// - An error if the query fails.
+func stageForLevel(q sqlExecutor, species string, level int) (speciesForm, error) {
+	form := speciesForm{Stage: stageBaby, MinLevel: 1}
+	err := q.QueryRow("SELECT stage, display_name, min_level FROM species_forms WHERE species_id = ? AND min_level <= ? ORDER BY min_level DESC LIMIT 1",
+		species, level).Scan(&form.Stage, &form.DisplayName, &form.MinLevel)
+	if err != nil && err != sql.ErrNoRows {
+		return form, err
+	}
+	return form, nil
+}
+
+// progressResult describes what an XP award changed, for publishing after commit.
+type progressResult struct {
+	XP            int
+	PreviousLevel int
+	Level         int
+	PreviousStage string
+	Stage         string
+	Form          string
+	Unlocks       []levelUnlock
+	Entries       []*activityEntry
+}
+
+// awardXPTx adds XP to a pet and applies any level-ups and evolutions it causes. Pets that
+// have passed away do not gain XP.
+// Parameters:
+// - tx: The transaction to run in.
+// - p: The pet; its XP, Level and Stage are updated.
+// - amount: The XP to add.
+// - actorID: The user whose action earned the XP, or 0.
+// Returns:
+// - What changed. Publish it with publishProgress once the transaction commits.
+// - An error if a write fails.
+func awardXPTx(tx *sql.Tx, p *petRecord, amount int, actorID int) (*progressResult, error) {
+	res := &progressResult{XP: p.XP, PreviousLevel: p.Level, Level: p.Level, PreviousStage: p.Stage, Stage: p.Stage}
+	if amount <= 0 || p.State == statePassedAway {
+		return res, nil
+	}
+
+	p.XP += amount
+	p.Level = levelForXP(p.XP)
+	form, err := stageForLevel(tx, p.Species, p.Level)
+	if err != nil {
+		return nil, err
+	}
+	p.Stage = form.Stage
+	if _, err := tx.Exec("UPDATE pets SET xp = ?, level = ?, stage = ? WHERE id = ?", p.XP, p.Level, p.Stage, p.ID); err != nil {
+		return nil, err
+	}
+	res.XP, res.Level, res.Stage, res.Form = p.XP, p.Level, p.Stage, form.DisplayName
+
+	if res.Level > res.PreviousLevel {
+		res.Unlocks = unlocksBetween(res.PreviousLevel, res.Level)
+		// Every level gained also earns a chest.
+		for level := res.PreviousLevel + 1; level <= res.Level; level++ {
+			res.Unlocks = append(res.Unlocks, levelUnlock{Level: level, Kind: "chest", ID: levelUpChest})
+		}
+		if err := grantChestsTx(tx, p.ID, levelUpChest, res.Level-res.PreviousLevel); err != nil {
+			return nil, err
+		}
+		entry, err := recordActivity(tx, p.ID, actorID, activityLevelUp, fmt.Sprintf("%s reached level %d", p.Name, p.Level),
+			map[string]interface{}{"level": p.Level, "previous_level": res.PreviousLevel, "unlocks": res.Unlocks})
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+	if res.Stage != res.PreviousStage {
+		entry, err := recordActivity(tx, p.ID, actorID, activityEvolved, fmt.Sprintf("%s evolved into %s", p.Name, form.DisplayName),
+			map[string]interface{}{"stage": p.Stage, "previous_stage": res.PreviousStage, "form": form.DisplayName})
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+	return res, nil
+}
+
+// publishProgress pushes level-ups and evolutions from an XP award to every connected owner.
+// Parameters:
+// - p: The pet that gained XP.
+// - res: The result of awardXPTx. A nil result is ignored.
+func publishProgress(p *petRecord, res *progressResult) {
+	if res == nil {
+		return
+	}
+	for _, entry := range res.Entries {
+		publishActivity(entry)
+	}
+	var msgs []map[string]interface{}
+	if res.Level > res.PreviousLevel {
+		msgs = append(msgs, map[string]interface{}{
+			"type":           "PetLevelUp",
+			"pet_id":         p.ID,
+			"level":          res.Level,
+			"previous_level": res.PreviousLevel,
+			"xp":             res.XP,
+			"unlocks":        res.Unlocks,
+		})
+	}
+	if res.Stage != res.PreviousStage {
+		msgs = append(msgs, map[string]interface{}{
+			"type":           "PetEvolved",
+			"pet_id":         p.ID,
+			"stage":          res.Stage,
+			"previous_stage": res.PreviousStage,
+			"form":           res.Form,
+		})
+	}
+	for _, msg := range msgs {
+		for _, ownerID := range p.ownerIDs() {
+			sendToUser(ownerID, msg)
+		}
+	}
+}
+
+// petProgressHandler returns a pet's level, evolution and unlocks.
+// Endpoint: GET /pets/{id}/progress
+// Response:
+// - 200 OK with xp, level, next-level XP, the current and possible forms, and unlocked and upcoming rewards.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the pet's privacy setting does not allow the caller to visit.
+// - 404 Not Found if the pet does not exist.
+func petProgressHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := canVisitPet(pet, userID)
+	if err != nil {
+		http.Error(w, "Error checking pet access", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "You are not allowed to visit this pet", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query("SELECT stage, display_name, min_level FROM species_forms WHERE species_id = ? ORDER BY min_level", pet.Species)
+	if err != nil {
+		logMessage("pet_progress_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading forms", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	forms := []speciesForm{}
+	current := speciesForm{Stage: pet.Stage}
+	for rows.Next() {
+		var f speciesForm
+		if err := rows.Scan(&f.Stage, &f.DisplayName, &f.MinLevel); err != nil {
+			http.Error(w, "Error reading forms", http.StatusInternalServerError)
+			return
+		}
+		if f.Stage == pet.Stage {
+			current = f
+		}
+		forms = append(forms, f)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading forms", http.StatusInternalServerError)
+		return
+	}
+
+	var nextLevelXP interface{}
+	if pet.Level < maxLevel {
+		nextLevelXP = xpForLevel(pet.Level + 1)
+	}
+	var nextUnlock interface{}
+	for _, u := range levelUnlocks {
+		if u.Level > pet.Level {
+			nextUnlock = u
+			break
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pet_id":        pet.ID,
+		"xp":            pet.XP,
+		"level":         pet.Level,
+		"next_level_xp": nextLevelXP,
+		"stage":         pet.Stage,
+		"form":          current,
+		"forms":         forms,
+		"unlocked":      unlocksBetween(0, pet.Level),
+		"next_unlock":   nextUnlock,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a fixed-window, per-user request limiter kept in memory.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[int]rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// newRateLimiter creates a limiter allowing limit requests per user in each window.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, windows: make(map[int]rateWindow)}
+}
+
+// allow records a request from the user and reports whether it is within the limit.
+// Parameters:
+// - userID: The ID of the user making the request.
+// Returns:
+// - A boolean indicating if the request may proceed.
+func (l *rateLimiter) allow(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w := l.windows[userID]
+	if now.Sub(w.start) >= l.window {
+		// Drop expired windows occasionally so the map does not grow without bound.
+		if len(l.windows) > 1024 {
+			for id, other := range l.windows {
+				if now.Sub(other.start) >= l.window {
+					delete(l.windows, id)
+				}
+			}
+		}
+		w = rateWindow{start: now}
+	}
+	if w.count >= l.limit {
+		return false
+	}
+	w.count++
+	l.windows[userID] = w
+	return true
+}
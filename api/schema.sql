@@ -6,18 +6,430 @@ CREATE TABLE IF NOT EXISTS users (
     password TEXT NOT NULL,
     SO INTEGER,
     pet_id INTEGER,
+    display_name TEXT,
+    private INTEGER NOT NULL DEFAULT 0,
+    last_seen TIMESTAMP,
+    coins INTEGER NOT NULL DEFAULT 20 CHECK(coins >= 0),
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    quiet_start TEXT,
+    quiet_end TEXT,
     FOREIGN KEY (SO) REFERENCES users(id),
     FOREIGN KEY (pet_id) REFERENCES pets(id)
 );
 
 CREATE TABLE IF NOT EXISTS pets (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL DEFAULT 'Motchi',
     main_owner INTEGER NOT NULL,
     owner2 INTEGER,
     money INTEGER NOT NULL CHECK(money >= 0),
     health INTEGER CHECK(health BETWEEN 1 AND 100) DEFAULT 100,
     hunger INTEGER CHECK(hunger BETWEEN 1 AND 100) DEFAULT 100,
     happiness INTEGER CHECK(happiness BETWEEN 1 AND 100) DEFAULT 100,
+    species TEXT NOT NULL DEFAULT 'pink_motchi',
+    visibility TEXT NOT NULL DEFAULT 'friends' CHECK(visibility IN ('private', 'friends', 'public')),
+    -- Stat decay bookkeeping: stats are current as of last_updated, after decay_steps steps.
+    last_updated TIMESTAMP,
+    decay_steps INTEGER NOT NULL DEFAULT 0,
+    state TEXT NOT NULL DEFAULT 'healthy',
+    state_since TIMESTAMP,
+    xp INTEGER NOT NULL DEFAULT 0 CHECK(xp >= 0),
+    level INTEGER NOT NULL DEFAULT 1,
+    stage TEXT NOT NULL DEFAULT 'baby',
+    mood TEXT NOT NULL DEFAULT 'content',
     FOREIGN KEY (main_owner) REFERENCES users(id),
     FOREIGN KEY (owner2) REFERENCES users(id)
-);
\ No newline at end of file
+);
+
+-- Friend requests and accepted friendships. A request is a single row from
+-- requester to addressee; accepting it flips the status, declining deletes it.
+CREATE TABLE IF NOT EXISTS friendships (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    requester_id INTEGER NOT NULL,
+    addressee_id INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending', 'accepted')),
+    created_at TIMESTAMP NOT NULL,
+    responded_at TIMESTAMP,
+    UNIQUE (requester_id, addressee_id),
+    FOREIGN KEY (requester_id) REFERENCES users(id),
+    FOREIGN KEY (addressee_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id),
+    FOREIGN KEY (blocked_id) REFERENCES users(id)
+);
+
+-- Per-pet activity feed shown to co-owners. actor_id is NULL for server-initiated events.
+CREATE TABLE IF NOT EXISTS pet_activity (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL,
+    actor_id INTEGER,
+    kind TEXT NOT NULL,
+    message TEXT NOT NULL,
+    data TEXT,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (actor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_pet_activity_pet ON pet_activity (pet_id, id);
+
+-- Weekly leaderboard seasons. The open season has archived_at NULL.
+CREATE TABLE IF NOT EXISTS leaderboard_seasons (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP
+);
+
+-- Live leaderboard scores. season_id 0 holds all-time scores; subject_id is a pet or user
+-- id depending on the metric.
+CREATE TABLE IF NOT EXISTS leaderboard_scores (
+    season_id INTEGER NOT NULL,
+    metric TEXT NOT NULL,
+    subject_id INTEGER NOT NULL,
+    score INTEGER NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (season_id, metric, subject_id)
+);
+
+-- Final standings of archived weekly seasons.
+CREATE TABLE IF NOT EXISTS leaderboard_archive (
+    season_id INTEGER NOT NULL,
+    metric TEXT NOT NULL,
+    subject_id INTEGER NOT NULL,
+    rank INTEGER NOT NULL,
+    score INTEGER NOT NULL,
+    PRIMARY KEY (season_id, metric, subject_id),
+    FOREIGN KEY (season_id) REFERENCES leaderboard_seasons(id)
+);
+
+-- Adoptable species. Decay multipliers scale how fast each stat drops; affinities scale
+-- how much food, play and healing restore.
+CREATE TABLE IF NOT EXISTS species (
+    id TEXT PRIMARY KEY,
+    display_name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    adoption_cost INTEGER NOT NULL CHECK(adoption_cost >= 0),
+    start_health INTEGER NOT NULL CHECK(start_health BETWEEN 1 AND 100),
+    start_hunger INTEGER NOT NULL CHECK(start_hunger BETWEEN 1 AND 100),
+    start_happiness INTEGER NOT NULL CHECK(start_happiness BETWEEN 1 AND 100),
+    hunger_decay REAL NOT NULL DEFAULT 1.0 CHECK(hunger_decay >= 0),
+    happiness_decay REAL NOT NULL DEFAULT 1.0 CHECK(happiness_decay >= 0),
+    health_decay REAL NOT NULL DEFAULT 1.0 CHECK(health_decay >= 0),
+    food_affinity REAL NOT NULL DEFAULT 1.0 CHECK(food_affinity >= 0),
+    play_affinity REAL NOT NULL DEFAULT 1.0 CHECK(play_affinity >= 0),
+    heal_affinity REAL NOT NULL DEFAULT 1.0 CHECK(heal_affinity >= 0),
+    available INTEGER NOT NULL DEFAULT 1
+);
+
+INSERT OR IGNORE INTO species (id, display_name, description, adoption_cost, start_health, start_hunger, start_happiness,
+    hunger_decay, happiness_decay, health_decay, food_affinity, play_affinity, heal_affinity) VALUES
+    ('pink_motchi', 'Ckerii', 'A tiny, cherry-shaped Motchi that glows brighter the more love it receives.', 10, 100, 100, 100, 1.0, 1.2, 1.0, 1.0, 1.5, 1.0),
+    ('blue_motchi', 'Blue Motchi', 'A calm, dewy Motchi that keeps its cool and rarely gets sad.', 15, 100, 100, 100, 1.1, 0.7, 1.0, 1.0, 1.0, 1.2),
+    ('cactee', 'Cactee', 'A prickly little cactus that barely needs feeding but craves attention.', 20, 100, 100, 80, 0.5, 1.3, 0.8, 1.5, 1.2, 0.8);
+
+-- Species-specific evolution forms. A pet takes the form with the highest min_level it has reached.
+CREATE TABLE IF NOT EXISTS species_forms (
+    species_id TEXT NOT NULL,
+    stage TEXT NOT NULL CHECK(stage IN ('baby', 'child', 'teen', 'adult')),
+    display_name TEXT NOT NULL,
+    min_level INTEGER NOT NULL,
+    PRIMARY KEY (species_id, stage),
+    FOREIGN KEY (species_id) REFERENCES species(id)
+);
+
+INSERT OR IGNORE INTO species_forms (species_id, stage, display_name, min_level) VALUES
+    ('pink_motchi', 'baby', 'Ckerii Seed', 1),
+    ('pink_motchi', 'child', 'Ckerii Bud', 5),
+    ('pink_motchi', 'teen', 'Ckerii Blossom', 10),
+    ('pink_motchi', 'adult', 'Grand Ckerii', 20),
+    ('blue_motchi', 'baby', 'Dewdrop', 1),
+    ('blue_motchi', 'child', 'Puddle Motchi', 5),
+    ('blue_motchi', 'teen', 'Tide Motchi', 10),
+    ('blue_motchi', 'adult', 'Ocean Motchi', 20),
+    ('cactee', 'baby', 'Sproutee', 1),
+    ('cactee', 'child', 'Cactee', 6),
+    ('cactee', 'teen', 'Saguaree', 12),
+    ('cactee', 'adult', 'Bloomee', 25);
+
+-- Pets that have passed away. The pets row is kept; this is the owners' keepsake.
+CREATE TABLE IF NOT EXISTS pet_memorials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    species TEXT NOT NULL,
+    main_owner INTEGER NOT NULL,
+    owner2 INTEGER,
+    adopted_at TIMESTAMP,
+    passed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (main_owner) REFERENCES users(id),
+    FOREIGN KEY (owner2) REFERENCES users(id)
+);
+
+-- Vacations pause a pet's decay and lifecycle between starts_at and ends_at, or until
+-- ended_at when a vacation is cut short.
+CREATE TABLE IF NOT EXISTS pet_vacations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL,
+    started_by INTEGER NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP,
+    end_reason TEXT,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (started_by) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_pet_vacations_pet ON pet_vacations (pet_id, starts_at);
+
+-- Time series of pet stats, sampled on every change and at least hourly. Raw samples are
+-- averaged into hourly rows after 7 days and hourly rows into daily rows after 30 days.
+CREATE TABLE IF NOT EXISTS pet_stat_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL,
+    recorded_at TIMESTAMP NOT NULL,
+    resolution TEXT NOT NULL DEFAULT 'raw' CHECK(resolution IN ('raw', 'hour', 'day')),
+    health REAL NOT NULL,
+    hunger REAL NOT NULL,
+    happiness REAL NOT NULL,
+    money REAL NOT NULL,
+    xp REAL NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_pet_stat_history_pet ON pet_stat_history (pet_id, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_pet_stat_history_resolution ON pet_stat_history (resolution, recorded_at);
+
+-- Minigame sessions issued by POST /minigames/{game}/sessions. A session can be completed
+-- once; completed_at, score and the rewards are set when it is.
+CREATE TABLE IF NOT EXISTS minigame_sessions (
+    id TEXT PRIMARY KEY,
+    game TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    pet_id INTEGER NOT NULL,
+    seed INTEGER NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP,
+    score INTEGER,
+    coins INTEGER NOT NULL DEFAULT 0,
+    xp INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (pet_id) REFERENCES pets(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_minigame_sessions_user ON minigame_sessions (user_id, completed_at);
+
+-- Append-only ledger of every change to a pet's money, written in the same database
+-- transaction as the balance update.
+CREATE TABLE IF NOT EXISTS transactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL,
+    user_id INTEGER,
+    amount INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    reference TEXT,
+    balance_after INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_pet ON transactions (pet_id, id);
+
+CREATE TRIGGER IF NOT EXISTS transactions_no_update BEFORE UPDATE ON transactions
+BEGIN
+    SELECT RAISE(ABORT, 'transactions are append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS transactions_no_delete BEFORE DELETE ON transactions
+BEGIN
+    SELECT RAISE(ABORT, 'transactions are append-only');
+END;
+
+-- Responses to money-changing WebSocket messages, keyed by the client's idempotency_key, so
+-- a retried message is answered without charging again. Pruned after a day.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INTEGER NOT NULL,
+    idempotency_key TEXT NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, idempotency_key),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- The shop catalog. Every item restores one stat by its magnitude, before the species
+-- affinity is applied. stock is NULL for unlimited items; an item is on sale while it is
+-- available and inside its optional availability window, to pets of at least min_level.
+-- A pet's inventory holds at most stack_limit of each item. stack_limit is added to older
+-- databases after this file runs, so the seeded items get theirs from dataMigrations in main.go.
+CREATE TABLE IF NOT EXISTS items (
+    id TEXT PRIMARY KEY,
+    display_name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    label TEXT NOT NULL,
+    effect TEXT NOT NULL CHECK (effect IN ('hunger', 'happiness', 'health')),
+    magnitude INTEGER NOT NULL CHECK (magnitude > 0),
+    price INTEGER NOT NULL CHECK (price >= 0),
+    stock INTEGER CHECK (stock >= 0),
+    min_level INTEGER NOT NULL DEFAULT 1,
+    stack_limit INTEGER NOT NULL DEFAULT 10 CHECK (stack_limit > 0),
+    available_from TIMESTAMP,
+    available_until TIMESTAMP,
+    available INTEGER NOT NULL DEFAULT 1,
+    sort_order INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT OR IGNORE INTO items (id, display_name, description, label, effect, magnitude, price, min_level, sort_order) VALUES
+    ('apple', 'Apple', 'A shiny red apple with a sweet aroma. Crunchy, refreshing, and perfect for a quick snack. Replenishes hunger by 15.', 'an apple', 'hunger', 15, 5, 1, 1),
+    ('teddy_bear', 'Teddy Bear', 'A soft, well-loved plush bear. Its stitched smile never fades, bringing comfort to anyone who holds it. Gives 25 happiness.', 'a teddy bear', 'happiness', 25, 15, 1, 2),
+    ('potion', 'Potion', 'A tiny glass vial filled with sparkly pink-red liquid. It tastes a little like cherries and makes your cheeks warm. Restores 15 HP.', 'a potion', 'health', 15, 10, 1, 3),
+    ('cake', 'Cake', 'A fluffy strawberry sponge with far too much frosting. Replenishes hunger by 40.', 'a slice of cake', 'hunger', 40, 12, 3, 4),
+    ('golden_apple', 'Golden Apple', 'An apple that shimmers like treasure. Restores 40 HP.', 'a golden apple', 'health', 40, 25, 8, 5),
+    ('rocket_toy', 'Rocket Toy', 'A wind-up rocket that whooshes around the room. Gives 50 happiness.', 'a rocket toy', 'happiness', 50, 30, 15, 6);
+
+-- Items a pet owns, shared by its owners. A stack is deleted when its last item is used.
+CREATE TABLE IF NOT EXISTS pet_inventory (
+    pet_id INTEGER NOT NULL,
+    item_id TEXT NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity >= 0),
+    acquired_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (pet_id, item_id),
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (item_id) REFERENCES items(id)
+);
+
+-- Chests a pet holds, shared by its owners. Chest types and their drop tables are defined
+-- in chests.go.
+CREATE TABLE IF NOT EXISTS pet_chests (
+    pet_id INTEGER NOT NULL,
+    chest_id TEXT NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity >= 0),
+    PRIMARY KEY (pet_id, chest_id),
+    FOREIGN KEY (pet_id) REFERENCES pets(id)
+);
+
+-- Cosmetics a pet has won from chests. Level cosmetics are not stored; they follow the level.
+CREATE TABLE IF NOT EXISTS pet_cosmetics (
+    pet_id INTEGER NOT NULL,
+    cosmetic_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    acquired_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (pet_id, cosmetic_id),
+    FOREIGN KEY (pet_id) REFERENCES pets(id)
+);
+
+-- Per-user server seeds for chest rolls. seed_hash (SHA-256 of server_seed) is shown when
+-- the seed is committed; server_seed is shown once revealed_at is set. nonce counts the
+-- openings rolled with the seed. A user has at most one unrevealed seed.
+CREATE TABLE IF NOT EXISTS chest_seeds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    server_seed TEXT NOT NULL,
+    seed_hash TEXT NOT NULL,
+    nonce INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    revealed_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_chest_seeds_active ON chest_seeds (user_id) WHERE revealed_at IS NULL;
+
+-- Audit log of every chest opening: the inputs of the roll, the pity counter it was rolled
+-- with, and what it paid out. coins is what was credited, including duplicate conversions.
+CREATE TABLE IF NOT EXISTS chest_openings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    pet_id INTEGER NOT NULL,
+    chest_id TEXT NOT NULL,
+    seed_id INTEGER NOT NULL,
+    client_seed TEXT NOT NULL,
+    nonce INTEGER NOT NULL,
+    pity INTEGER NOT NULL,
+    tier TEXT NOT NULL,
+    tier_rank INTEGER NOT NULL,
+    drop_kind TEXT NOT NULL CHECK (drop_kind IN ('coins', 'item', 'cosmetic')),
+    drop_id TEXT,
+    amount INTEGER NOT NULL,
+    duplicate INTEGER NOT NULL DEFAULT 0,
+    coins INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (seed_id) REFERENCES chest_seeds(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chest_openings_user ON chest_openings (user_id, chest_id, id);
+
+CREATE TRIGGER IF NOT EXISTS chest_openings_no_update BEFORE UPDATE ON chest_openings
+BEGIN
+    SELECT RAISE(ABORT, 'chest openings are append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS chest_openings_no_delete BEFORE DELETE ON chest_openings
+BEGIN
+    SELECT RAISE(ABORT, 'chest openings are append-only');
+END;
+
+-- Care streaks. Days are dates (YYYY-MM-DD) in the main owner's time zone. grace_days is
+-- how many missed days the streak can still survive; claimed_day is the last day its
+-- reward was claimed by either owner.
+CREATE TABLE IF NOT EXISTS pet_streaks (
+    pet_id INTEGER PRIMARY KEY,
+    current INTEGER NOT NULL DEFAULT 0,
+    longest INTEGER NOT NULL DEFAULT 0,
+    last_day TEXT,
+    grace_days INTEGER NOT NULL DEFAULT 1,
+    grace_used_on TEXT,
+    claimed_day TEXT,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id)
+);
+
+-- The main owner's limits on owner2's spending from a pet. NULL means no limit. Spends by
+-- owner2 above approval_threshold become spending_requests.
+CREATE TABLE IF NOT EXISTS spending_policies (
+    pet_id INTEGER PRIMARY KEY,
+    daily_limit INTEGER CHECK (daily_limit >= 0),
+    weekly_limit INTEGER CHECK (weekly_limit >= 0),
+    approval_threshold INTEGER CHECK (approval_threshold >= 0),
+    updated_by INTEGER NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (updated_by) REFERENCES users(id)
+);
+
+-- Purchases by owner2 waiting for, or decided by, the main owner. An approved purchase is
+-- made when it is approved, at completed_at. Requests are never deleted, for audit.
+CREATE TABLE IF NOT EXISTS spending_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pet_id INTEGER NOT NULL,
+    requester_id INTEGER NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('item', 'chest')),
+    ref TEXT NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    amount INTEGER NOT NULL CHECK (amount >= 0),
+    description TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('pending', 'approved', 'denied')),
+    created_at TIMESTAMP NOT NULL,
+    decided_by INTEGER,
+    decided_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    FOREIGN KEY (pet_id) REFERENCES pets(id),
+    FOREIGN KEY (requester_id) REFERENCES users(id),
+    FOREIGN KEY (decided_by) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_spending_requests_pet ON spending_requests (pet_id, status, id);
+
+CREATE TRIGGER IF NOT EXISTS spending_requests_no_delete BEFORE DELETE ON spending_requests
+BEGIN
+    SELECT RAISE(ABORT, 'spending requests are kept for audit');
+END;
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// searchLimiter caps how often a single user may call GET /users/search.
+var searchLimiter = newRateLimiter(30, time.Minute)
+
+// maxDisplayNameLength is the longest display name a user may choose, in characters.
+const maxDisplayNameLength = 50
+
+// userSearchResult describes a user returned by GET /users/search.
+type userSearchResult struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	HasPartner  bool   `json:"has_partner"`
+	SharesPet   bool   `json:"shares_pet"`
+	IsFriend    bool   `json:"is_friend"`
+}
+
+// escapeLike escapes the LIKE wildcards in s so it can be used as a literal prefix with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// searchUsersHandler performs a prefix search over usernames and display names.
+// Blocked users (in either direction), private accounts and the caller are excluded.
+// Endpoint: GET /users/search?q=<prefix>&limit=<n>&offset=<n>
+// Response:
+// - 200 OK with a page of matching users, each flagged with has_partner and shares_pet.
+// - 400 Bad Request if q is shorter than two characters.
+// - 401 Unauthorized if the user is not authenticated.
+// - 429 Too Many Requests if the caller exceeds the search rate limit.
+func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	if !searchLimiter.allow(userID) {
+		http.Error(w, "Too many searches, slow down", http.StatusTooManyRequests)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(q)) < 2 {
+		http.Error(w, "q must be at least 2 characters", http.StatusBadRequest)
+		return
+	}
+	limit, offset := parsePagination(r)
+	prefix := escapeLike(q) + "%"
+
+	// Fetch one extra row so we can tell the client whether another page exists.
+	rows, err := db.Query(`SELECT u.id, u.username, COALESCE(u.display_name, ''),
+			u.SO IS NOT NULL OR EXISTS (SELECT 1 FROM pets p WHERE (p.main_owner = u.id OR p.owner2 = u.id) AND p.owner2 IS NOT NULL),
+			EXISTS (SELECT 1 FROM pets p WHERE (p.main_owner = u.id AND p.owner2 = ?) OR (p.owner2 = u.id AND p.main_owner = ?)),
+			EXISTS (SELECT 1 FROM friendships f WHERE f.status = 'accepted' AND ((f.requester_id = u.id AND f.addressee_id = ?) OR (f.requester_id = ? AND f.addressee_id = u.id)))
+		FROM users u
+		WHERE u.id != ?
+			AND u.private = 0
+			AND (u.username LIKE ? ESCAPE '\' OR u.display_name LIKE ? ESCAPE '\')
+			AND NOT EXISTS (SELECT 1 FROM blocks b WHERE (b.blocker_id = ? AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = ?))
+		ORDER BY u.username
+		LIMIT ? OFFSET ?`,
+		userID, userID, userID, userID, userID, prefix, prefix, userID, userID, limit+1, offset)
+	if err != nil {
+		logMessage("user_search_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		http.Error(w, "Error searching users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := []userSearchResult{}
+	for rows.Next() {
+		var res userSearchResult
+		if err := rows.Scan(&res.ID, &res.Username, &res.DisplayName, &res.HasPartner, &res.SharesPet, &res.IsFriend); err != nil {
+			logMessage("user_search_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+			http.Error(w, "Error searching users", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error searching users", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(results) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+	logMessage("user_search", map[string]interface{}{"user_id": userID, "q": q, "results": len(results)})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    results,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
+
+// updateProfileHandler updates the caller's display name, search visibility, time zone
+// and quiet hours.
+// Endpoint: PUT /profile
+// Request Body (all fields optional):
+// - display_name: The name shown to other users (at most 50 characters).
+// - private: When true, the account is hidden from GET /users/search.
+// - timezone: An IANA time zone such as "Europe/Berlin".
+// - quiet_start, quiet_end: Quiet hours as "HH:MM" local times. Set both, or clear both with "".
+// Response:
+// - 200 OK on success.
+// - 400 Bad Request if the request body is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		DisplayName *string `json:"display_name"`
+		Private     *bool   `json:"private"`
+		Timezone    *string `json:"timezone"`
+		QuietStart  *string `json:"quiet_start"`
+		QuietEnd    *string `json:"quiet_end"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Timezone != nil {
+		if _, err := time.LoadLocation(*req.Timezone); err != nil || *req.Timezone == "" || *req.Timezone == "Local" {
+			http.Error(w, "timezone must be an IANA time zone, e.g. Europe/Berlin", http.StatusBadRequest)
+			return
+		}
+	}
+	if (req.QuietStart == nil) != (req.QuietEnd == nil) || (req.QuietStart != nil && (*req.QuietStart == "") != (*req.QuietEnd == "")) {
+		http.Error(w, "quiet_start and quiet_end must be set or cleared together", http.StatusBadRequest)
+		return
+	}
+	var quietStart, quietEnd sql.NullString
+	if req.QuietStart != nil && *req.QuietStart != "" {
+		start, err1 := parseClock(*req.QuietStart)
+		end, err2 := parseClock(*req.QuietEnd)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "quiet_start and quiet_end must be HH:MM times", http.StatusBadRequest)
+			return
+		}
+		if start == end {
+			http.Error(w, "quiet_start and quiet_end must differ", http.StatusBadRequest)
+			return
+		}
+		quietStart = sql.NullString{String: *req.QuietStart, Valid: true}
+		quietEnd = sql.NullString{String: *req.QuietEnd, Valid: true}
+	}
+
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if len([]rune(name)) > maxDisplayNameLength {
+			http.Error(w, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength), http.StatusBadRequest)
+			return
+		}
+		displayName := sql.NullString{String: name, Valid: name != ""}
+		if _, err := db.Exec("UPDATE users SET display_name = ? WHERE id = ?", displayName, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Private != nil {
+		if _, err := db.Exec("UPDATE users SET private = ? WHERE id = ?", *req.Private, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Timezone != nil {
+		if _, err := db.Exec("UPDATE users SET timezone = ? WHERE id = ?", *req.Timezone, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.QuietStart != nil {
+		if _, err := db.Exec("UPDATE users SET quiet_start = ?, quiet_end = ? WHERE id = ?", quietStart, quietEnd, userID); err != nil {
+			http.Error(w, "Error updating profile", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	logMessage("update_profile", map[string]interface{}{"user_id": userID})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Profile updated successfully"))
+}
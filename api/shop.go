@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// effectActions maps an item's effect to the care action that uses it.
+var effectActions = map[string]string{
+	"hunger":    careFeed,
+	"happiness": carePlay,
+	"health":    careHeal,
+}
+
+// shopItem is a row of the items catalog.
+type shopItem struct {
+	ID             string     `json:"id"`
+	DisplayName    string     `json:"display_name"`
+	Description    string     `json:"description"`
+	Label          string     `json:"-"` // used in feed messages, e.g. "an apple"
+	Effect         string     `json:"effect"`
+	Magnitude      int        `json:"magnitude"`
+	Price          int        `json:"price"`
+	Stock          *int       `json:"stock"`
+	MinLevel       int        `json:"min_level"`
+	StackLimit     int        `json:"stack_limit"`
+	AvailableFrom  *time.Time `json:"available_from"`
+	AvailableUntil *time.Time `json:"available_until"`
+	Available      bool       `json:"-"`
+}
+
+const itemColumns = "id, display_name, description, label, effect, magnitude, price, stock, min_level, stack_limit, available_from, available_until, available"
+
+func scanItem(row interface{ Scan(...interface{}) error }) (*shopItem, error) {
+	var it shopItem
+	var stock sql.NullInt64
+	var from, until sql.NullTime
+	err := row.Scan(&it.ID, &it.DisplayName, &it.Description, &it.Label, &it.Effect, &it.Magnitude, &it.Price,
+		&stock, &it.MinLevel, &it.StackLimit, &from, &until, &it.Available)
+	if err != nil {
+		return nil, err
+	}
+	if stock.Valid {
+		n := int(stock.Int64)
+		it.Stock = &n
+	}
+	if from.Valid {
+		it.AvailableFrom = &from.Time
+	}
+	if until.Valid {
+		it.AvailableUntil = &until.Time
+	}
+	return &it, nil
+}
+
+// loadItem reads an item from the catalog, whether or not it is on sale.
+// Parameters:
+// - q: The database or transaction to read from.
+// - id: The item id, e.g. "apple".
+// Returns:
+// - The item.
+// - sql.ErrNoRows if the item does not exist, or another error if the query fails.
+func loadItem(q sqlExecutor, id string) (*shopItem, error) {
+	return scanItem(q.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = ?", id))
+}
+
+// action returns the care action the item is used with.
+func (it *shopItem) action() string {
+	return effectActions[it.Effect]
+}
+
+// onSale reports whether the item can be bought at the given time, ignoring stock and level.
+func (it *shopItem) onSale(now time.Time) bool {
+	if !it.Available {
+		return false
+	}
+	if it.AvailableFrom != nil && now.Before(*it.AvailableFrom) {
+		return false
+	}
+	return it.AvailableUntil == nil || now.Before(*it.AvailableUntil)
+}
+
+// listShopHandler returns the items on sale, in shop order.
+// Endpoint: GET /shop
+// Response:
+// - 200 OK with the items. When the caller has a pet, each item also says whether the pet has reached its level and can afford it.
+// - 401 Unauthorized if the user is not authenticated.
+func listShopHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	var pet *petRecord
+	if petID, err := getUserPetID(userID); err == nil {
+		pet, _ = loadPet(db, petID)
+	}
+
+	rows, err := db.Query("SELECT " + itemColumns + " FROM items WHERE available = 1 ORDER BY sort_order, price, id")
+	if err != nil {
+		logMessage("list_shop_error", map[string]interface{}{"error": err.Error()})
+		http.Error(w, "Error reading shop", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type shopEntry struct {
+		*shopItem
+		Unlocked   *bool `json:"unlocked,omitempty"`
+		Affordable *bool `json:"affordable,omitempty"`
+	}
+	now := time.Now().UTC()
+	items := []shopEntry{}
+	for rows.Next() {
+		it, err := scanItem(rows)
+		if err != nil {
+			http.Error(w, "Error reading shop", http.StatusInternalServerError)
+			return
+		}
+		if !it.onSale(now) {
+			continue
+		}
+		entry := shopEntry{shopItem: it}
+		if pet != nil {
+			unlocked, affordable := pet.Level >= it.MinLevel, pet.Money >= it.Price
+			entry.Unlocked, entry.Affordable = &unlocked, &affordable
+		}
+		items = append(items, entry)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading shop", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// buyItemHandler buys items into the caller's pet's inventory. The price is taken from the
+// pet's money in the same transaction.
+// Endpoint: POST /shop/buy
+// Request Body:
+// - item: The id of the item to buy.
+// - quantity: Optional. How many to buy; defaults to 1.
+// Response:
+// - 200 OK with the item id, how many the pet now owns, and the updated pet.
+// - 202 Accepted with a pending spending request if the purchase needs the main owner's approval.
+// - 400 Bad Request if the body or quantity is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 402 Payment Required if the pet cannot afford the items.
+// - 403 Forbidden if the pet has not reached the item's level, or the purchase would go over the caller's spending limit.
+// - 404 Not Found if the item is unknown or the caller has no pet.
+// - 409 Conflict if the item is not on sale or sold out, the stack would be over its limit, or the pet has passed away.
+func buyItemHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Item     string `json:"item"`
+		Quantity int    `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Item == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	item, err := loadItem(db, req.Item)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown item", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading shop", http.StatusInternalServerError)
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Caller has no pet", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error buying item", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	owned, entry, err := buyItemTx(tx, pet, userID, item, req.Quantity, time.Now())
+	if err != nil {
+		var needsApproval *approvalRequired
+		if errors.As(err, &needsApproval) {
+			tx.Rollback()
+			writeApprovalRequested(w, pet, userID, spendingKindItem, item.ID, req.Quantity, needsApproval.Cost, itemQuantityLabel(item, req.Quantity))
+			return
+		}
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			http.Error(w, refusal.Message, refusal.Status)
+			return
+		}
+		logMessage("shop_buy_error", map[string]interface{}{"error": err.Error(), "pet_id": petID, "item": item.ID})
+		http.Error(w, "Error buying item", http.StatusInternalServerError)
+		return
+	}
+	if pet, err = loadPet(tx, petID); err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error buying item", http.StatusInternalServerError)
+		return
+	}
+	publishPetStats(pet)
+	publishInventory(pet, item.ID, owned)
+	publishActivity(entry)
+
+	logMessage("shop_buy", map[string]interface{}{"pet_id": petID, "user_id": userID, "item": item.ID, "quantity": req.Quantity, "price": item.Price})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"item":     item.ID,
+		"quantity": owned,
+		"pet":      petData(pet),
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	_ "time/tzdata" // users pick IANA time zones; don't depend on the host's zoneinfo
+)
+
+// Default night, in the owner's local time, for owners who have not set quiet hours.
+const (
+	defaultBedtime = 22 * 60 // minutes after midnight
+	defaultWake    = 7 * 60
+)
+
+// sleepSchedule is the nightly window of one owner.
+type sleepSchedule struct {
+	Location *time.Location
+	Start    int  // minutes after local midnight
+	End      int  // minutes after local midnight; may be before Start when the window spans midnight
+	Quiet    bool // true when the owner set quiet hours explicitly
+}
+
+// contains reports whether t falls inside the window.
+func (s sleepSchedule) contains(t time.Time) bool {
+	local := t.In(s.Location)
+	m := local.Hour()*60 + local.Minute()
+	if s.Start <= s.End {
+		return m >= s.Start && m < s.End
+	}
+	return m >= s.Start || m < s.End
+}
+
+// parseClock parses an "HH:MM" time of day.
+// Returns:
+// - Minutes after midnight.
+// - An error if the value is not a valid time of day.
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an HH:MM time", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// loadSleepSchedule reads a user's time zone and quiet hours. Without quiet hours the
+// owner's night runs from 22:00 to 07:00 local time; an unknown time zone falls back to UTC.
+// Parameters:
+// - q: The database or transaction to read from.
+// - userID: The ID of the user.
+// Returns:
+// - The user's schedule.
+// - An error if the query fails.
+func loadSleepSchedule(q sqlExecutor, userID int) (sleepSchedule, error) {
+	var tz string
+	var quietStart, quietEnd sql.NullString
+	if err := q.QueryRow("SELECT timezone, quiet_start, quiet_end FROM users WHERE id = ?", userID).Scan(&tz, &quietStart, &quietEnd); err != nil {
+		return sleepSchedule{}, err
+	}
+	s := sleepSchedule{Location: time.UTC, Start: defaultBedtime, End: defaultWake}
+	if loc, err := time.LoadLocation(tz); err == nil {
+		s.Location = loc
+	}
+	if quietStart.Valid && quietEnd.Valid {
+		start, err1 := parseClock(quietStart.String)
+		end, err2 := parseClock(quietEnd.String)
+		if err1 == nil && err2 == nil {
+			s.Start, s.End, s.Quiet = start, end, true
+		}
+	}
+	return s, nil
+}
+
+// ownerSchedules loads the sleep schedule of every owner of a pet.
+func ownerSchedules(q sqlExecutor, p *petRecord) ([]sleepSchedule, error) {
+	var schedules []sleepSchedule
+	for _, ownerID := range p.ownerIDs() {
+		s, err := loadSleepSchedule(q, ownerID)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// asleepAt decides whether a pet sleeps at a moment. When co-owners live in different time
+// zones the pet only sleeps while it is night for all of them, so it is awake whenever any
+// owner might want to play.
+func asleepAt(schedules []sleepSchedule, t time.Time) bool {
+	if len(schedules) == 0 {
+		return false
+	}
+	for _, s := range schedules {
+		if !s.contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// petAsleep reports whether a pet is sleeping at the given time.
+// Parameters:
+// - q: The database or transaction to read from.
+// - p: The pet.
+// - now: The time to check.
+// Returns:
+// - A boolean indicating if the pet is asleep.
+// - An error if an owner cannot be read.
+func petAsleep(q sqlExecutor, p *petRecord, now time.Time) (bool, error) {
+	schedules, err := ownerSchedules(q, p)
+	if err != nil {
+		return false, err
+	}
+	return asleepAt(schedules, now), nil
+}
+
+// inQuietHours reports whether a user has quiet hours set and is inside them.
+func inQuietHours(userID int, now time.Time) bool {
+	s, err := loadSleepSchedule(db, userID)
+	if err != nil {
+		return false
+	}
+	return s.Quiet && s.contains(now)
+}
+
+// notifyOwners pushes a server-initiated event to every connected owner of a pet, except
+// owners who are inside their quiet hours. They see the current state on their next GetData.
+// Parameters:
+// - p: The pet the event is about.
+// - msg: The message to send.
+func notifyOwners(p *petRecord, msg interface{}) {
+	now := time.Now()
+	for _, ownerID := range p.ownerIDs() {
+		if inQuietHours(ownerID, now) {
+			continue
+		}
+		sendToUser(ownerID, msg)
+	}
+}
+
+// sendToOwners pushes a message to every connected owner of a pet.
+func sendToOwners(p *petRecord, msg interface{}) {
+	for _, ownerID := range p.ownerIDs() {
+		sendToUser(ownerID, msg)
+	}
+}
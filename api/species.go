@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// defaultSpecies is adopted when POST /create_pet does not name a species.
+const defaultSpecies = "pink_motchi"
+
+// adoptionAllowance is the coins a user is given to adopt with: once when their account is
+// created, and again as a top-up when their pet passes away. It covers every seeded species.
+const adoptionAllowance = 20
+
+// errInsufficientCoins is returned when a user cannot afford an adoption.
+var errInsufficientCoins = errors.New("insufficient coins")
+
+// errAlreadyHasPet is returned when a user who owns or co-owns a living pet tries to adopt.
+var errAlreadyHasPet = errors.New("user already has a pet")
+
+// speciesRecord is a row of the species catalog.
+type speciesRecord struct {
+	ID             string  `json:"id"`
+	DisplayName    string  `json:"display_name"`
+	Description    string  `json:"description"`
+	AdoptionCost   int     `json:"adoption_cost"`
+	StartHealth    int     `json:"start_health"`
+	StartHunger    int     `json:"start_hunger"`
+	StartHappiness int     `json:"start_happiness"`
+	HungerDecay    float64 `json:"hunger_decay"`
+	HappinessDecay float64 `json:"happiness_decay"`
+	HealthDecay    float64 `json:"health_decay"`
+	FoodAffinity   float64 `json:"food_affinity"`
+	PlayAffinity   float64 `json:"play_affinity"`
+	HealAffinity   float64 `json:"heal_affinity"`
+}
+
+const speciesColumns = "id, display_name, description, adoption_cost, start_health, start_hunger, start_happiness, hunger_decay, happiness_decay, health_decay, food_affinity, play_affinity, heal_affinity"
+
+func scanSpecies(row interface{ Scan(...interface{}) error }) (*speciesRecord, error) {
+	var s speciesRecord
+	err := row.Scan(&s.ID, &s.DisplayName, &s.Description, &s.AdoptionCost, &s.StartHealth, &s.StartHunger, &s.StartHappiness,
+		&s.HungerDecay, &s.HappinessDecay, &s.HealthDecay, &s.FoodAffinity, &s.PlayAffinity, &s.HealAffinity)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// loadSpecies reads a species from the catalog.
+// Parameters:
+// - q: The database or transaction to read from.
+// - id: The species id, e.g. "pink_motchi".
+// Returns:
+// - The species.
+// - sql.ErrNoRows if the species does not exist or is not available, or another error if the query fails.
+func loadSpecies(q sqlExecutor, id string) (*speciesRecord, error) {
+	return scanSpecies(q.QueryRow("SELECT "+speciesColumns+" FROM species WHERE id = ? AND available = 1", id))
+}
+
+// adoptPetTx charges the user the species' adoption cost and creates their pet with the
+// species' starting stats, all inside the caller's transaction.
+// Parameters:
+// - tx: The transaction to run in.
+// - userID: The ID of the adopting user.
+// - sp: The species to adopt.
+// - name: The validated name of the new pet.
+// Returns:
+// - The new pet's ID.
+// - errAlreadyHasPet if the user owns or co-owns a pet that has not passed away, errInsufficientCoins if the user cannot afford the species, or another error if a write fails.
+func adoptPetTx(tx *sql.Tx, userID int, sp *speciesRecord, name string) (int, error) {
+	// Adopting over a living pet would leave it, its money and its inventory without an owner.
+	var living int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pets WHERE state != ? AND (id = (SELECT pet_id FROM users WHERE id = ?) OR owner2 = ?)",
+		statePassedAway, userID, userID).Scan(&living); err != nil {
+		return 0, err
+	}
+	if living > 0 {
+		return 0, errAlreadyHasPet
+	}
+
+	// The conditional update makes the balance check and the deduction a single step.
+	res, err := tx.Exec("UPDATE users SET coins = coins - ? WHERE id = ? AND coins >= ?", sp.AdoptionCost, userID, sp.AdoptionCost)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errInsufficientCoins
+	}
+
+	res, err = tx.Exec("INSERT INTO pets (main_owner, owner2, money, health, hunger, happiness, species, name, last_updated) VALUES (?, NULL, 0, ?, ?, ?, ?, ?, ?)",
+		userID, sp.StartHealth, sp.StartHunger, sp.StartHappiness, sp.ID, name, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	petID64, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	petID := int(petID64)
+
+	if err := recordLeaderboardScore(tx, "happiness", petID, sp.StartHappiness); err != nil {
+		return 0, err
+	}
+
+	// Update the user's pet_id to the new pet id.
+	if _, err := tx.Exec("UPDATE users SET pet_id = ? WHERE id = ?", petID, userID); err != nil {
+		return 0, err
+	}
+	return petID, nil
+}
+
+// listSpeciesHandler returns the species that can be adopted.
+// Endpoint: GET /species
+// Response:
+// - 200 OK with the catalog, the caller's coin balance, and whether each species is affordable.
+// - 401 Unauthorized if the user is not authenticated.
+func listSpeciesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var coins int
+	if err := db.QueryRow("SELECT coins FROM users WHERE id = ?", userID).Scan(&coins); err != nil {
+		http.Error(w, "Error reading user", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT " + speciesColumns + " FROM species WHERE available = 1 ORDER BY adoption_cost, id")
+	if err != nil {
+		logMessage("list_species_error", map[string]interface{}{"error": err.Error()})
+		http.Error(w, "Error reading species", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type speciesEntry struct {
+		*speciesRecord
+		Affordable bool `json:"affordable"`
+	}
+	catalog := []speciesEntry{}
+	for rows.Next() {
+		sp, err := scanSpecies(rows)
+		if err != nil {
+			http.Error(w, "Error reading species", http.StatusInternalServerError)
+			return
+		}
+		catalog = append(catalog, speciesEntry{speciesRecord: sp, Affordable: coins >= sp.AdoptionCost})
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading species", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"coins":   coins,
+		"species": catalog,
+	})
+}
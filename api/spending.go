@@ -0,0 +1,638 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Statuses of a spending request. An approved request is paid for when it is approved;
+// completed_at records when.
+const (
+	spendingPending  = "pending"
+	spendingApproved = "approved"
+	spendingDenied   = "denied"
+)
+
+// Kinds of purchase a spending request can be for.
+const (
+	spendingKindItem  = "item"
+	spendingKindChest = "chest"
+)
+
+// spendingPolicy is the main owner's guardrail on owner2's spending from a pet. A nil
+// field means no limit. Limits count every coin owner2 spent from the pet since the start
+// of the UTC day or week (Monday).
+type spendingPolicy struct {
+	DailyLimit        *int       `json:"daily_limit"`
+	WeeklyLimit       *int       `json:"weekly_limit"`
+	ApprovalThreshold *int       `json:"approval_threshold"` // spends above this need approval
+	UpdatedAt         *time.Time `json:"updated_at"`
+}
+
+// loadSpendingPolicy reads a pet's spending policy, or an empty policy if it has none.
+func loadSpendingPolicy(q sqlExecutor, petID int) (*spendingPolicy, error) {
+	p := &spendingPolicy{}
+	var daily, weekly, threshold sql.NullInt64
+	var updatedAt sql.NullTime
+	err := q.QueryRow("SELECT daily_limit, weekly_limit, approval_threshold, updated_at FROM spending_policies WHERE pet_id = ?", petID).
+		Scan(&daily, &weekly, &threshold, &updatedAt)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.DailyLimit, p.WeeklyLimit, p.ApprovalThreshold = nullIntPtr(daily), nullIntPtr(weekly), nullIntPtr(threshold)
+	if updatedAt.Valid {
+		p.UpdatedAt = &updatedAt.Time
+	}
+	return p, nil
+}
+
+// nullIntPtr converts a nullable column to a pointer, nil for NULL.
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// startOfWeek returns the start of the UTC week (Monday) containing t.
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// spentSince returns how many coins a user has spent from a pet since the given time.
+func spentSince(q sqlExecutor, petID, userID int, since time.Time) (int, error) {
+	var spent int
+	err := q.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM transactions WHERE pet_id = ? AND user_id = ? AND amount < 0 AND created_at >= ?",
+		petID, userID, since.UTC()).Scan(&spent)
+	return spent, err
+}
+
+// approvalRequired is returned by checkSpendingTx when a spend needs the main owner's
+// approval. It unwraps to a *careRefusal, so callers that cannot ask for approval report it
+// like any other refusal.
+type approvalRequired struct {
+	Cost    int
+	refusal careRefusal
+}
+
+func (e *approvalRequired) Error() string { return e.refusal.Message }
+
+func (e *approvalRequired) Unwrap() error { return &e.refusal }
+
+// checkSpendingTx enforces a pet's spending policy on a spend by one of its owners. The main
+// owner is never limited. A spend the main owner approved is let through once, even if it
+// is over a limit.
+// Parameters:
+// - tx: The transaction the spend runs in.
+// - pet: The pet paying.
+// - userID: The ID of the owner spending.
+// - cost: The coins about to be spent.
+// - now: The current time.
+// Returns:
+// - An *approvalRequired if the spend is over the approval threshold, a *careRefusal if it would exceed a limit, or another error if a query fails.
+func checkSpendingTx(tx sqlExecutor, pet *petRecord, userID int, cost int, now time.Time) error {
+	if userID == pet.MainOwner || cost <= 0 {
+		return nil
+	}
+	res, err := tx.Exec(`UPDATE spending_requests SET completed_at = ? WHERE id = (
+		SELECT id FROM spending_requests WHERE pet_id = ? AND requester_id = ? AND status = ? AND completed_at IS NULL AND amount >= ?
+		ORDER BY id LIMIT 1)`, now.UTC(), pet.ID, userID, spendingApproved, cost)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	policy, err := loadSpendingPolicy(tx, pet.ID)
+	if err != nil {
+		return err
+	}
+	if policy.ApprovalThreshold != nil && cost > *policy.ApprovalThreshold {
+		return &approvalRequired{Cost: cost, refusal: careRefusal{Status: http.StatusForbidden,
+			Message: fmt.Sprintf("Spending more than %d coins at once needs the main owner's approval", *policy.ApprovalThreshold)}}
+	}
+	limits := []struct {
+		limit *int
+		since time.Time
+		name  string
+	}{
+		{policy.DailyLimit, startOfDay(now), "daily"},
+		{policy.WeeklyLimit, startOfWeek(now), "weekly"},
+	}
+	for _, l := range limits {
+		if l.limit == nil {
+			continue
+		}
+		spent, err := spentSince(tx, pet.ID, userID, l.since)
+		if err != nil {
+			return err
+		}
+		if spent+cost > *l.limit {
+			return &careRefusal{Status: http.StatusForbidden,
+				Message: fmt.Sprintf("This would go over your %s spending limit of %d coins (%d left)", l.name, *l.limit, max(0, *l.limit-spent))}
+		}
+	}
+	return nil
+}
+
+// spendingRequest is a purchase by owner2 waiting for, or decided by, the main owner.
+type spendingRequest struct {
+	ID          int64      `json:"id"`
+	PetID       int        `json:"pet_id"`
+	RequesterID int        `json:"requester_id"`
+	Kind        string     `json:"kind"`
+	Ref         string     `json:"ref"` // the item or chest id
+	Quantity    int        `json:"quantity"`
+	Amount      int        `json:"amount"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DecidedBy   *int       `json:"decided_by"`
+	DecidedAt   *time.Time `json:"decided_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+const spendingRequestColumns = "id, pet_id, requester_id, kind, ref, quantity, amount, description, status, created_at, decided_by, decided_at, completed_at"
+
+func scanSpendingRequest(row interface{ Scan(...interface{}) error }) (*spendingRequest, error) {
+	var req spendingRequest
+	var decidedBy sql.NullInt64
+	var decidedAt, completedAt sql.NullTime
+	err := row.Scan(&req.ID, &req.PetID, &req.RequesterID, &req.Kind, &req.Ref, &req.Quantity, &req.Amount, &req.Description,
+		&req.Status, &req.CreatedAt, &decidedBy, &decidedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	req.DecidedBy = nullIntPtr(decidedBy)
+	if decidedAt.Valid {
+		req.DecidedAt = &decidedAt.Time
+	}
+	if completedAt.Valid {
+		req.CompletedAt = &completedAt.Time
+	}
+	return &req, nil
+}
+
+// requestApproval records a purchase that needs the main owner's approval, and pushes it to
+// them as a SpendingApprovalRequest. If the same purchase is already pending for at least
+// the amount, that request is returned instead.
+// Parameters:
+// - pet: The pet the purchase is for.
+// - userID: The ID of the owner asking.
+// - kind: spendingKindItem or spendingKindChest.
+// - ref: The item or chest id.
+// - quantity: How many to buy.
+// - amount: What the purchase costs.
+// - description: What is being bought, e.g. "3 × Cake".
+// Returns:
+// - The pending request.
+// - An error if a query fails.
+func requestApproval(pet *petRecord, userID int, kind, ref string, quantity, amount int, description string) (*spendingRequest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanSpendingRequest(tx.QueryRow("SELECT "+spendingRequestColumns+
+		" FROM spending_requests WHERE pet_id = ? AND requester_id = ? AND kind = ? AND ref = ? AND quantity = ? AND status = ? AND amount >= ?",
+		pet.ID, userID, kind, ref, quantity, spendingPending, amount))
+	if err == nil {
+		return existing, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	description = fmt.Sprintf("%s wants to buy %s for %s for %d coins", userDisplayName(tx, userID), description, pet.Name, amount)
+	res, err := tx.Exec(`INSERT INTO spending_requests (pet_id, requester_id, kind, ref, quantity, amount, description, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, pet.ID, userID, kind, ref, quantity, amount, description, spendingPending, now)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	req := &spendingRequest{ID: id, PetID: pet.ID, RequesterID: userID, Kind: kind, Ref: ref, Quantity: quantity, Amount: amount,
+		Description: description, Status: spendingPending, CreatedAt: now}
+	entry, err := recordActivity(tx, pet.ID, userID, activitySpendingRequested, description,
+		map[string]interface{}{"request_id": id, "kind": kind, "ref": ref, "quantity": quantity, "amount": amount})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logMessage("spending_requested", map[string]interface{}{"pet_id": pet.ID, "user_id": userID, "request_id": id, "amount": amount})
+	sendToUser(pet.MainOwner, map[string]interface{}{
+		"type":    "SpendingApprovalRequest",
+		"pet_id":  pet.ID,
+		"request": req,
+	})
+	publishActivity(entry)
+	return req, nil
+}
+
+// writeApprovalRequested asks the main owner to approve a purchase that checkSpendingTx
+// held back, and answers 202 Accepted with the pending request.
+func writeApprovalRequested(w http.ResponseWriter, pet *petRecord, userID int, kind, ref string, quantity, amount int, description string) {
+	req, err := requestApproval(pet, userID, kind, ref, quantity, amount, description)
+	if err != nil {
+		logMessage("spending_request_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error requesting approval", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":  "pending_approval",
+		"request": req,
+	})
+}
+
+// spendingPolicyHandler returns a pet's spending policy and what owner2 has spent so far.
+// Endpoint: GET /pets/{id}/spending
+// Response:
+// - 200 OK with the policy, owner2's spending today and this week, and the number of pending requests.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func spendingPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	pet, ok := ownedPetFromPath(w, r, userID)
+	if !ok {
+		return
+	}
+	writeSpendingPolicy(w, pet)
+}
+
+// writeSpendingPolicy writes the response of GET /pets/{id}/spending.
+func writeSpendingPolicy(w http.ResponseWriter, pet *petRecord) {
+	policy, err := loadSpendingPolicy(db, pet.ID)
+	if err != nil {
+		logMessage("spending_policy_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error reading spending policy", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]interface{}{
+		"pet_id":             pet.ID,
+		"daily_limit":        policy.DailyLimit,
+		"weekly_limit":       policy.WeeklyLimit,
+		"approval_threshold": policy.ApprovalThreshold,
+		"updated_at":         policy.UpdatedAt,
+		"owner2":             nil,
+	}
+	if pet.Owner2.Valid {
+		owner2 := int(pet.Owner2.Int64)
+		now := time.Now()
+		today, err1 := spentSince(db, pet.ID, owner2, startOfDay(now))
+		week, err2 := spentSince(db, pet.ID, owner2, startOfWeek(now))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Error reading spending policy", http.StatusInternalServerError)
+			return
+		}
+		resp["owner2"] = map[string]interface{}{"user_id": owner2, "spent_today": today, "spent_this_week": week}
+	}
+	var pending int
+	if err := db.QueryRow("SELECT COUNT(*) FROM spending_requests WHERE pet_id = ? AND status = ?", pet.ID, spendingPending).Scan(&pending); err != nil {
+		http.Error(w, "Error reading spending policy", http.StatusInternalServerError)
+		return
+	}
+	resp["pending_requests"] = pending
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ownedPetFromPath loads the {id} pet for one of its owners, writing the error response
+// if the pet is missing or the caller does not own it.
+func ownedPetFromPath(w http.ResponseWriter, r *http.Request, userID int) (*petRecord, bool) {
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return nil, false
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can manage a pet's spending", http.StatusForbidden)
+		return nil, false
+	}
+	return pet, true
+}
+
+// updateSpendingPolicyHandler replaces a pet's spending policy. Only the main owner can set it.
+// Endpoint: PUT /pets/{id}/spending
+// Request Body:
+// - daily_limit: Coins owner2 can spend per UTC day, or null for no limit.
+// - weekly_limit: Coins owner2 can spend per UTC week (from Monday), or null for no limit.
+// - approval_threshold: Purchases by owner2 costing more than this need approval, or null for none.
+// Response:
+// - 200 OK with the new policy, as GET /pets/{id}/spending.
+// - 400 Bad Request if the body is invalid or a value is negative.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller is not the main owner.
+// - 404 Not Found if the pet does not exist.
+func updateSpendingPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	pet, ok := ownedPetFromPath(w, r, userID)
+	if !ok {
+		return
+	}
+	if userID != pet.MainOwner {
+		http.Error(w, "Only the main owner can set spending limits", http.StatusForbidden)
+		return
+	}
+	var req spendingPolicy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, v := range []*int{req.DailyLimit, req.WeeklyLimit, req.ApprovalThreshold} {
+		if v != nil && *v < 0 {
+			http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error saving spending policy", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	toNull := func(v *int) sql.NullInt64 {
+		if v == nil {
+			return sql.NullInt64{}
+		}
+		return sql.NullInt64{Int64: int64(*v), Valid: true}
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO spending_policies (pet_id, daily_limit, weekly_limit, approval_threshold, updated_by, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (pet_id) DO UPDATE SET daily_limit = excluded.daily_limit, weekly_limit = excluded.weekly_limit,
+		approval_threshold = excluded.approval_threshold, updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		pet.ID, toNull(req.DailyLimit), toNull(req.WeeklyLimit), toNull(req.ApprovalThreshold), userID, now)
+	if err != nil {
+		logMessage("spending_policy_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error saving spending policy", http.StatusInternalServerError)
+		return
+	}
+	entry, err := recordActivity(tx, pet.ID, userID, activitySpendingPolicyChanged,
+		fmt.Sprintf("%s changed the spending limits for %s", userDisplayName(tx, userID), pet.Name),
+		map[string]interface{}{"daily_limit": req.DailyLimit, "weekly_limit": req.WeeklyLimit, "approval_threshold": req.ApprovalThreshold})
+	if err != nil {
+		http.Error(w, "Error saving spending policy", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error saving spending policy", http.StatusInternalServerError)
+		return
+	}
+	publishActivity(entry)
+
+	logMessage("spending_policy_updated", map[string]interface{}{"pet_id": pet.ID, "user_id": userID})
+	writeSpendingPolicy(w, pet)
+}
+
+// spendingRequestsHandler returns a page of a pet's spending requests, newest first.
+// Endpoint: GET /pets/{id}/spending/requests?status=<status>&limit=<n>&offset=<n>
+// Response:
+// - 200 OK with the requests.
+// - 400 Bad Request if the status is unknown.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func spendingRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	pet, ok := ownedPetFromPath(w, r, userID)
+	if !ok {
+		return
+	}
+	limit, offset := parsePagination(r)
+	query := "SELECT " + spendingRequestColumns + " FROM spending_requests WHERE pet_id = ?"
+	args := []interface{}{pet.ID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != spendingPending && status != spendingApproved && status != spendingDenied {
+			http.Error(w, "status must be pending, approved or denied", http.StatusBadRequest)
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit+1, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logMessage("spending_requests_error", map[string]interface{}{"error": err.Error(), "pet_id": pet.ID})
+		http.Error(w, "Error reading requests", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	items := []*spendingRequest{}
+	for rows.Next() {
+		req, err := scanSpendingRequest(rows)
+		if err != nil {
+			http.Error(w, "Error reading requests", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, req)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading requests", http.StatusInternalServerError)
+		return
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"items":    items,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": hasMore,
+	})
+}
+
+// checkRequestedPrice refuses to make an approved purchase that now costs more than the
+// amount the requester asked for.
+// Parameters:
+// - req: The request being approved.
+// - price: The current price of one of the requested items or chests.
+// Returns:
+// - A *careRefusal with 409 Conflict if the purchase now costs more, otherwise nil.
+func checkRequestedPrice(req *spendingRequest, price int) error {
+	if cost := price * req.Quantity; cost > req.Amount {
+		return &careRefusal{Status: http.StatusConflict,
+			Message: fmt.Sprintf("The price has gone up to %d coins since %d were requested", cost, req.Amount)}
+	}
+	return nil
+}
+
+// decideSpendingRequestHandler approves or denies a pending spending request. Approving it
+// makes the purchase for the requester at once, at the current price, as long as that is
+// not more than the requested amount.
+// Endpoint: POST /pets/{id}/spending/requests/{request}/approve, POST /pets/{id}/spending/requests/{request}/deny
+// Response:
+// - 200 OK with the decided request and the updated pet.
+// - 401 Unauthorized if the user is not authenticated.
+// - 402 Payment Required if the pet can no longer afford an approved purchase.
+// - 403 Forbidden if the caller is not the main owner.
+// - 404 Not Found if the pet or request does not exist.
+// - 409 Conflict if the request was already decided, the price has gone up since it was made, or the purchase cannot be made any more.
+func decideSpendingRequestHandler(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := authenticateRequest(w, r)
+		if !ok {
+			return
+		}
+		pet, ok := ownedPetFromPath(w, r, userID)
+		if !ok {
+			return
+		}
+		if userID != pet.MainOwner {
+			http.Error(w, "Only the main owner can decide spending requests", http.StatusForbidden)
+			return
+		}
+		requestID, err := strconv.ParseInt(r.PathValue("request"), 10, 64)
+		if err != nil {
+			http.Error(w, "Request not found", http.StatusNotFound)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Error deciding request", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		req, err := scanSpendingRequest(tx.QueryRow("SELECT "+spendingRequestColumns+" FROM spending_requests WHERE id = ? AND pet_id = ?", requestID, pet.ID))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Request not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error deciding request", http.StatusInternalServerError)
+			return
+		}
+		if req.Status != spendingPending {
+			http.Error(w, fmt.Sprintf("Request was already %s", req.Status), http.StatusConflict)
+			return
+		}
+
+		now := time.Now().UTC()
+		req.Status, req.DecidedBy, req.DecidedAt = spendingDenied, &userID, &now
+		if approve {
+			req.Status = spendingApproved
+		}
+		if _, err := tx.Exec("UPDATE spending_requests SET status = ?, decided_by = ?, decided_at = ? WHERE id = ?", req.Status, userID, now, req.ID); err != nil {
+			logMessage("spending_decide_error", map[string]interface{}{"error": err.Error(), "request_id": req.ID})
+			http.Error(w, "Error deciding request", http.StatusInternalServerError)
+			return
+		}
+
+		// The purchase goes through the requester's usual path; checkSpendingTx lets it
+		// through once against the request just approved.
+		var entries []*activityEntry
+		itemTotal := 0
+		if approve {
+			var entry *activityEntry
+			switch req.Kind {
+			case spendingKindItem:
+				var item *shopItem
+				if item, err = loadItem(tx, req.Ref); err == nil {
+					if err = checkRequestedPrice(req, item.Price); err == nil {
+						itemTotal, entry, err = buyItemTx(tx, pet, req.RequesterID, item, req.Quantity, now)
+					}
+				}
+			case spendingKindChest:
+				if err = checkRequestedPrice(req, chestTypes[req.Ref].Price); err == nil {
+					_, entry, err = buyChestTx(tx, pet, req.RequesterID, req.Ref, req.Quantity, now)
+				}
+			}
+			if err != nil {
+				var refusal *careRefusal
+				if errors.As(err, &refusal) {
+					http.Error(w, refusal.Message, refusal.Status)
+					return
+				}
+				logMessage("spending_decide_error", map[string]interface{}{"error": err.Error(), "request_id": req.ID})
+				http.Error(w, "Error deciding request", http.StatusInternalServerError)
+				return
+			}
+			entries = append(entries, entry)
+			if _, err := tx.Exec("UPDATE spending_requests SET completed_at = COALESCE(completed_at, ?) WHERE id = ?", now, req.ID); err != nil {
+				http.Error(w, "Error deciding request", http.StatusInternalServerError)
+				return
+			}
+			req.CompletedAt = &now
+		}
+
+		kind, verb := activitySpendingDenied, "denied"
+		if approve {
+			kind, verb = activitySpendingApproved, "approved"
+		}
+		entry, err := recordActivity(tx, pet.ID, userID, kind,
+			fmt.Sprintf("%s %s: %s", userDisplayName(tx, userID), verb, req.Description),
+			map[string]interface{}{"request_id": req.ID, "amount": req.Amount})
+		if err != nil {
+			http.Error(w, "Error deciding request", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, entry)
+		if pet, err = loadPet(tx, pet.ID); err != nil {
+			http.Error(w, "Error reading pet", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Error deciding request", http.StatusInternalServerError)
+			return
+		}
+
+		if approve {
+			publishPetStats(pet)
+			if req.Kind == spendingKindItem {
+				publishInventory(pet, req.Ref, itemTotal)
+			}
+		}
+		for _, e := range entries {
+			publishActivity(e)
+		}
+		sendToUser(req.RequesterID, map[string]interface{}{
+			"type":    "SpendingRequestDecided",
+			"pet_id":  pet.ID,
+			"request": req,
+		})
+
+		logMessage("spending_decided", map[string]interface{}{"pet_id": pet.ID, "user_id": userID, "request_id": req.ID, "status": req.Status})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"request": req,
+			"pet":     petData(pet),
+		})
+	}
+}
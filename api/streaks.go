@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Kinds of streak reward.
+const (
+	streakRewardCoins = "coins"
+	streakRewardItem  = "item"
+	streakRewardChest = "chest"
+)
+
+// streakWeek is the length of the reward calendar. Completing a week of the streak also
+// restores its grace day.
+const streakWeek = 7
+
+// streakReward is the payout for one day of the reward calendar. Amount is coins for
+// coins, and the quantity for items and chests.
+type streakReward struct {
+	Day    int    `json:"day"`
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"`
+	Amount int    `json:"amount"`
+}
+
+// streakCalendar pays for each day of a streak, repeating every streakWeek days.
+var streakCalendar = [streakWeek]streakReward{
+	{Day: 1, Kind: streakRewardCoins, Amount: 5},
+	{Day: 2, Kind: streakRewardCoins, Amount: 10},
+	{Day: 3, Kind: streakRewardItem, ID: "apple", Amount: 2},
+	{Day: 4, Kind: streakRewardCoins, Amount: 15},
+	{Day: 5, Kind: streakRewardItem, ID: "teddy_bear", Amount: 1},
+	{Day: 6, Kind: streakRewardCoins, Amount: 25},
+	{Day: 7, Kind: streakRewardChest, ID: levelUpChest, Amount: 1},
+}
+
+// rewardForStreak returns the calendar entry for the given day of a streak.
+func rewardForStreak(streak int) streakReward {
+	return streakCalendar[(streak-1)%streakWeek]
+}
+
+// petStreak is a pet's care streak. Days are dates in the main owner's time zone.
+type petStreak struct {
+	Current     int
+	Longest     int
+	LastDay     string // the last day with a care action, as YYYY-MM-DD
+	GraceDays   int    // missed days the streak can still survive
+	ClaimedDay  string // the last day a reward was claimed
+	GraceUsedOn string // the last day the streak was kept alive by a grace day
+}
+
+// streakLocation returns the time zone a pet's streak days follow: its main owner's.
+func streakLocation(q sqlExecutor, p *petRecord) (*time.Location, error) {
+	s, err := loadSleepSchedule(q, p.MainOwner)
+	if err != nil {
+		return nil, err
+	}
+	return s.Location, nil
+}
+
+// daysBetween returns how many days after the date from the date to is. Both are YYYY-MM-DD.
+func daysBetween(from, to string) int {
+	f, err1 := time.Parse(time.DateOnly, from)
+	t, err2 := time.Parse(time.DateOnly, to)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return int(t.Sub(f).Hours() / 24)
+}
+
+// loadStreak reads a pet's streak, or a zero streak if it has none.
+func loadStreak(q sqlExecutor, petID int) (*petStreak, error) {
+	s := &petStreak{}
+	var lastDay, claimedDay, graceUsedOn sql.NullString
+	err := q.QueryRow("SELECT current, longest, last_day, grace_days, claimed_day, grace_used_on FROM pet_streaks WHERE pet_id = ?", petID).
+		Scan(&s.Current, &s.Longest, &lastDay, &s.GraceDays, &claimedDay, &graceUsedOn)
+	if err == sql.ErrNoRows {
+		return &petStreak{GraceDays: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.LastDay, s.ClaimedDay, s.GraceUsedOn = lastDay.String, claimedDay.String, graceUsedOn.String
+	return s, nil
+}
+
+// alive reports whether the streak can still be continued today: its last care day is
+// today or yesterday, or the day before with a grace day left.
+func (s *petStreak) alive(today string) bool {
+	if s.Current == 0 {
+		return false
+	}
+	gap := daysBetween(s.LastDay, today)
+	return gap <= 1 || (gap == 2 && s.GraceDays > 0)
+}
+
+// recordCareDayTx counts a care action towards a pet's streak. The first care action of a
+// day extends the streak if the pet was cared for the day before, or the day before that
+// using up the grace day; otherwise the streak starts again at 1. The new length is recorded
+// on the care_streak leaderboard in the same transaction.
+// Parameters:
+// - tx: The transaction to run in.
+// - p: The pet that was cared for.
+// - now: The time of the care action.
+// Returns:
+// - The updated streak, or nil if the pet was already cared for today.
+// - An error if a query fails.
+func recordCareDayTx(tx *sql.Tx, p *petRecord, now time.Time) (*petStreak, error) {
+	loc, err := streakLocation(tx, p)
+	if err != nil {
+		return nil, err
+	}
+	today := now.In(loc).Format(time.DateOnly)
+	s, err := loadStreak(tx, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if s.LastDay == today {
+		return nil, nil
+	}
+
+	switch gap := daysBetween(s.LastDay, today); {
+	case s.Current > 0 && gap == 1:
+		s.Current++
+	case s.Current > 0 && gap == 2 && s.GraceDays > 0:
+		s.Current++
+		s.GraceDays--
+		s.GraceUsedOn = today
+	default:
+		s.Current, s.GraceDays = 1, 1
+	}
+	if s.Current%streakWeek == 0 {
+		s.GraceDays = 1
+	}
+	s.Longest = max(s.Longest, s.Current)
+	s.LastDay = today
+
+	_, err = tx.Exec(`INSERT INTO pet_streaks (pet_id, current, longest, last_day, grace_days, grace_used_on, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (pet_id) DO UPDATE SET current = excluded.current, longest = excluded.longest, last_day = excluded.last_day,
+		grace_days = excluded.grace_days, grace_used_on = excluded.grace_used_on, updated_at = excluded.updated_at`,
+		p.ID, s.Current, s.Longest, s.LastDay, s.GraceDays, sql.NullString{String: s.GraceUsedOn, Valid: s.GraceUsedOn != ""}, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	if err := recordLeaderboardScore(tx, "care_streak", p.ID, s.Current); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// streakView describes a pet's streak as of today, for GET /pets/{id}/streak and StreakUpdate.
+func streakView(p *petRecord, s *petStreak, loc *time.Location, now time.Time) map[string]interface{} {
+	today := now.In(loc).Format(time.DateOnly)
+	current := s.Current
+	if !s.alive(today) {
+		current = 0
+	}
+	caredToday := s.LastDay == today
+	claimable := caredToday && s.ClaimedDay != today
+	// Today's reward once the pet has been cared for, otherwise the one the next care action earns.
+	next := rewardForStreak(current + 1)
+	if caredToday {
+		next = rewardForStreak(current)
+	}
+	return map[string]interface{}{
+		"pet_id":        p.ID,
+		"current":       current,
+		"longest":       s.Longest,
+		"last_care_day": nullIfEmpty(s.LastDay),
+		"today":         today,
+		"timezone":      loc.String(),
+		"cared_today":   caredToday,
+		"claimable":     claimable,
+		"claimed_today": s.ClaimedDay == today,
+		"grace_days":    s.GraceDays,
+		"grace_used_on": nullIfEmpty(s.GraceUsedOn),
+		"at_risk":       current > 0 && !caredToday && daysBetween(s.LastDay, today) == 2,
+		"reward":        next,
+		"calendar":      streakCalendar,
+	}
+}
+
+// nullIfEmpty returns nil for an empty string, so it is encoded as JSON null.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// publishStreak pushes a StreakUpdate to every connected owner of the pet.
+func publishStreak(p *petRecord, s *petStreak) {
+	if s == nil {
+		return
+	}
+	loc, err := streakLocation(db, p)
+	if err != nil {
+		logMessage("streak_error", map[string]interface{}{"error": err.Error(), "pet_id": p.ID})
+		return
+	}
+	msg := streakView(p, s, loc, time.Now())
+	msg["type"] = "StreakUpdate"
+	sendToOwners(p, msg)
+}
+
+// streakClaim is what claimStreakTx paid out, for publishing once the transaction commits.
+type streakClaim struct {
+	Streak    int
+	Reward    streakReward
+	Coins     int // coins added to the pet's money, including a full stack paid out in coins
+	ItemTotal int // the new size of the pet's stack, for item rewards
+	Pet       *petRecord
+	Entry     *activityEntry
+}
+
+// claimStreakTx pays today's streak reward to a pet. Either owner can claim it, once per day.
+// Parameters:
+// - tx: The transaction to run in.
+// - pet: The pet to pay.
+// - userID: The ID of the owner claiming.
+// - now: The current time.
+// Returns:
+// - What was paid.
+// - A *careRefusal if there is nothing to claim, or another error if a query fails.
+func claimStreakTx(tx *sql.Tx, pet *petRecord, userID int, now time.Time) (*streakClaim, error) {
+	if !pet.isOwner(userID) {
+		return nil, &careRefusal{Status: http.StatusForbidden, Message: "Only owners can claim a pet's streak reward"}
+	}
+	if pet.State == statePassedAway {
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("%s has passed away", pet.Name)}
+	}
+	loc, err := streakLocation(tx, pet)
+	if err != nil {
+		return nil, err
+	}
+	today := now.In(loc).Format(time.DateOnly)
+	s, err := loadStreak(tx, pet.ID)
+	if err != nil {
+		return nil, err
+	}
+	if s.LastDay != today {
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("Care for %s today to claim the streak reward", pet.Name)}
+	}
+	res, err := tx.Exec("UPDATE pet_streaks SET claimed_day = ?, updated_at = ? WHERE pet_id = ? AND (claimed_day IS NULL OR claimed_day != ?)",
+		today, now.UTC(), pet.ID, today)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, &careRefusal{Status: http.StatusConflict, Message: fmt.Sprintf("Today's streak reward for %s was already claimed", pet.Name)}
+	}
+
+	claim := &streakClaim{Streak: s.Current, Reward: rewardForStreak(s.Current)}
+	var won string
+	switch r := claim.Reward; r.Kind {
+	case streakRewardCoins:
+		claim.Coins = r.Amount
+		won = fmt.Sprintf("%d coins", r.Amount)
+	case streakRewardItem:
+		item, err := loadItem(tx, r.ID)
+		if err != nil {
+			return nil, err
+		}
+		claim.ItemTotal, err = addToInventoryTx(tx, pet.ID, item, r.Amount, now)
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			// A full stack is paid out at the shop price instead.
+			claim.Coins = item.Price * r.Amount
+			won = fmt.Sprintf("%d coins instead of %s", claim.Coins, item.DisplayName)
+		} else if err != nil {
+			return nil, err
+		} else {
+			won = fmt.Sprintf("%d × %s", r.Amount, item.DisplayName)
+		}
+	case streakRewardChest:
+		if err := grantChestsTx(tx, pet.ID, r.ID, r.Amount); err != nil {
+			return nil, err
+		}
+		won = fmt.Sprintf("a %s", chestTypes[r.ID].DisplayName)
+	}
+	if claim.Coins > 0 {
+		if _, err := tx.Exec("UPDATE pets SET money = money + ? WHERE id = ?", claim.Coins, pet.ID); err != nil {
+			return nil, err
+		}
+		if _, err := recordTransaction(tx, pet.ID, userID, claim.Coins, txReasonStreakReward, today); err != nil {
+			return nil, err
+		}
+		if err := recordLeaderboardScore(tx, "coins_earned", pet.ID, claim.Coins); err != nil {
+			return nil, err
+		}
+	}
+
+	if claim.Pet, err = loadPet(tx, pet.ID); err != nil {
+		return nil, err
+	}
+	claim.Entry, err = recordActivity(tx, pet.ID, userID, activityStreakClaimed,
+		fmt.Sprintf("%s claimed day %d of %s's care streak: %s", userDisplayName(tx, userID), claim.Streak, pet.Name, won),
+		map[string]interface{}{"streak": claim.Streak, "reward": claim.Reward, "coins": claim.Coins, "day": today})
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// handleClaimStreak pays today's care streak reward to the caller's pet.
+// The caller receives a StreakResponse; every owner receives the pet's new stats and streak.
+// A message repeating an earlier idempotency_key is answered with the earlier response.
+// Parameters:
+// - conn: The caller's connection.
+// - userID: The ID of the caller.
+// - message: The raw message, which must carry an "idempotency_key".
+func handleClaimStreak(conn *websocket.Conn, userID int, message []byte) {
+	const responseType = "StreakResponse"
+	key := idempotencyKey(message)
+	if key == "" {
+		economyFail(conn, responseType, "idempotency_key is required")
+		return
+	}
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+	petID, err := getUserPetID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			economyFail(conn, responseType, "Caller has no pet")
+			return
+		}
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	defer tx.Rollback()
+
+	// The write lock is taken at Begin, so a message with the same key that was still
+	// running when this one was checked above has committed by now.
+	if replayIdempotentResponse(conn, userID, key) {
+		return
+	}
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	claim, err := claimStreakTx(tx, pet, userID, now)
+	if err != nil {
+		var refusal *careRefusal
+		if errors.As(err, &refusal) {
+			economyFail(conn, responseType, refusal.Message)
+			return
+		}
+		logMessage("streak_claim_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	response := map[string]interface{}{
+		"type":     responseType,
+		"status":   "success",
+		"streak":   claim.Streak,
+		"reward":   claim.Reward,
+		"coins":    claim.Coins,
+		"newMoney": claim.Pet.Money,
+	}
+	if err := storeIdempotentResponseTx(tx, userID, key, response); err != nil {
+		tx.Rollback()
+		if err == errDuplicateRequest {
+			replayIdempotentResponse(conn, userID, key)
+			return
+		}
+		logMessage("streak_claim_error", map[string]interface{}{"error": err.Error(), "user_id": userID})
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		economyFail(conn, responseType, "Server error occurred")
+		return
+	}
+
+	writeConn(conn, response)
+	logMessage("streak_claim", map[string]interface{}{"user_id": userID, "pet_id": petID, "streak": claim.Streak, "kind": claim.Reward.Kind})
+	if claim.Coins > 0 {
+		sendToOwners(claim.Pet, petStatsMessage(claim.Pet))
+	}
+	if claim.Reward.Kind == streakRewardItem && claim.ItemTotal > 0 {
+		publishInventory(claim.Pet, claim.Reward.ID, claim.ItemTotal)
+	}
+	publishActivity(claim.Entry)
+	if s, err := loadStreak(db, petID); err == nil {
+		publishStreak(claim.Pet, s)
+	}
+}
+
+// petStreakHandler returns a pet's care streak and reward calendar.
+// Endpoint: GET /pets/{id}/streak
+// Response:
+// - 200 OK with the streak as of today in the main owner's time zone.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+func petStreakHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can read a pet's streak", http.StatusForbidden)
+		return
+	}
+	s, err := loadStreak(db, petID)
+	if err != nil {
+		logMessage("streak_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading streak", http.StatusInternalServerError)
+		return
+	}
+	loc, err := streakLocation(db, pet)
+	if err != nil {
+		http.Error(w, "Error reading streak", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, streakView(pet, s, loc, time.Now()))
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Vacation limits. Days are counted per UTC calendar month by the month a vacation starts
+// in; a vacation cut short only counts the days it actually lasted, rounded up.
+const (
+	maxVacationDays         = 14 // longest single vacation, in days
+	maxVacationDaysPerMonth = 14
+	vacationCooldown        = 7 * 24 * time.Hour // between the end of one vacation and the start of the next
+)
+
+// Reasons a vacation ended before its scheduled end.
+const (
+	vacationEndedByOwner    = "ended_by_owner"
+	vacationEndedOnInteract = "interaction"
+)
+
+// petVacation is one row of pet_vacations.
+type petVacation struct {
+	ID        int64      `json:"id"`
+	PetID     int        `json:"pet_id"`
+	StartedBy int        `json:"started_by"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    time.Time  `json:"ends_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"`
+}
+
+// end returns when the vacation stops pausing the pet.
+func (v *petVacation) end() time.Time {
+	if v.EndedAt != nil {
+		return *v.EndedAt
+	}
+	return v.EndsAt
+}
+
+// covers reports whether t falls inside the vacation.
+func (v *petVacation) covers(t time.Time) bool {
+	return !t.Before(v.StartsAt) && t.Before(v.end())
+}
+
+// days returns how many days the vacation counts against the monthly cap.
+func (v *petVacation) days() int {
+	return int(math.Ceil(v.end().Sub(v.StartsAt).Hours() / 24))
+}
+
+// queryVacations reads the vacations matching a WHERE clause, oldest first.
+func queryVacations(q sqlExecutor, where string, args ...interface{}) ([]*petVacation, error) {
+	rows, err := q.Query("SELECT id, pet_id, started_by, starts_at, ends_at, ended_at, end_reason FROM pet_vacations WHERE "+where+" ORDER BY starts_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vacations []*petVacation
+	for rows.Next() {
+		v := &petVacation{}
+		var endedAt sql.NullTime
+		var reason sql.NullString
+		if err := rows.Scan(&v.ID, &v.PetID, &v.StartedBy, &v.StartsAt, &v.EndsAt, &endedAt, &reason); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			v.EndedAt = &endedAt.Time
+		}
+		v.EndReason = reason.String
+		vacations = append(vacations, v)
+	}
+	return vacations, rows.Err()
+}
+
+// vacationsBetween returns the vacations of a pet that overlap [from, to).
+// Parameters:
+// - q: The database or transaction to read from.
+// - petID: The ID of the pet.
+// - from, to: The time range.
+// Returns:
+// - The overlapping vacations.
+// - An error if the query fails.
+func vacationsBetween(q sqlExecutor, petID int, from, to time.Time) ([]*petVacation, error) {
+	all, err := queryVacations(q, "pet_id = ? AND starts_at < ? AND ends_at > ?", petID, to.UTC(), from.UTC())
+	if err != nil {
+		return nil, err
+	}
+	var vacations []*petVacation
+	for _, v := range all {
+		if v.end().After(from) {
+			vacations = append(vacations, v)
+		}
+	}
+	return vacations, nil
+}
+
+// activeVacation returns the vacation a pet is on at the given time, or nil.
+func activeVacation(q sqlExecutor, petID int, now time.Time) (*petVacation, error) {
+	vacations, err := queryVacations(q, "pet_id = ? AND ended_at IS NULL AND starts_at <= ? AND ends_at > ?", petID, now.UTC(), now.UTC())
+	if err != nil || len(vacations) == 0 {
+		return nil, err
+	}
+	return vacations[0], nil
+}
+
+// onVacation reports whether any of the vacations covers t.
+func onVacation(vacations []*petVacation, t time.Time) bool {
+	for _, v := range vacations {
+		if v.covers(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// endVacationTx ends a pet's active vacation early, if it has one.
+// Parameters:
+// - q: The database or transaction to write to.
+// - p: The pet; its Vacation is cleared.
+// - actorID: The user who ended the vacation.
+// - reason: vacationEndedByOwner or vacationEndedOnInteract.
+// - now: The current time.
+// Returns:
+// - The ended vacation, or nil if the pet was not on vacation.
+// - The activity entry to publish with publishVacationEnded once the transaction commits.
+// - An error if a write fails.
+func endVacationTx(q sqlExecutor, p *petRecord, actorID int, reason string, now time.Time) (*petVacation, *activityEntry, error) {
+	v, err := activeVacation(q, p.ID, now)
+	if err != nil || v == nil {
+		return nil, nil, err
+	}
+	now = now.UTC()
+	if _, err := q.Exec("UPDATE pet_vacations SET ended_at = ?, end_reason = ? WHERE id = ?", now, reason, v.ID); err != nil {
+		return nil, nil, err
+	}
+	v.EndedAt, v.EndReason = &now, reason
+	p.Vacation = nil
+	entry, err := recordActivity(q, p.ID, actorID, activityVacationEnded,
+		fmt.Sprintf("%s's vacation ended early", p.Name), map[string]interface{}{"vacation_id": v.ID, "reason": reason})
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, entry, nil
+}
+
+// publishVacationEnded tells every connected owner that a vacation ended early.
+// Parameters:
+// - p: The pet.
+// - v: The ended vacation. A nil vacation is ignored.
+// - entry: The activity entry recorded by endVacationTx.
+func publishVacationEnded(p *petRecord, v *petVacation, entry *activityEntry) {
+	if v == nil {
+		return
+	}
+	publishActivity(entry)
+	sendToOwners(p, map[string]interface{}{
+		"type":     "VacationEnded",
+		"pet_id":   p.ID,
+		"vacation": v,
+		"reason":   v.EndReason,
+	})
+}
+
+// endVacationOnInteraction ends a pet's vacation because an owner interacted with it outside
+// of any transaction, logging failures.
+// Parameters:
+// - petID: The ID of the pet.
+// - userID: The owner who interacted.
+func endVacationOnInteraction(petID, userID int) {
+	pet, err := loadPet(db, petID)
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		return
+	}
+	v, entry, err := endVacationTx(db, pet, userID, vacationEndedOnInteract, time.Now())
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		return
+	}
+	publishVacationEnded(pet, v, entry)
+}
+
+// startVacationHandler puts a pet on vacation, pausing its decay and lifecycle.
+// Endpoint: POST /pets/{id}/vacation
+// Request Body:
+// - days: The length of the vacation, 1 to 14.
+// Response:
+// - 201 Created with the vacation.
+// - 400 Bad Request if the body or days is invalid.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist.
+// - 409 Conflict if the pet is already on vacation, has fainted or passed away, is in its cooldown, or the monthly cap would be exceeded.
+func startVacationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Days int `json:"days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Days < 1 || req.Days > maxVacationDays {
+		http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxVacationDays), http.StatusBadRequest)
+		return
+	}
+
+	// Settle the pet's stats up to now so the pause starts from its current state.
+	if _, err := refreshPet(petID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error starting vacation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can send a pet on vacation", http.StatusForbidden)
+		return
+	}
+	if pet.State == stateFainted || pet.State == statePassedAway {
+		http.Error(w, fmt.Sprintf("%s cannot go on vacation while %s", pet.Name, pet.State), http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	// Look back far enough to see this month's vacations and any whose cooldown is still running.
+	since := monthStart
+	if c := now.Add(-maxVacationDays*24*time.Hour - vacationCooldown); c.Before(since) {
+		since = c
+	}
+	past, err := queryVacations(tx, "pet_id = ? AND starts_at >= ?", petID, since)
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error starting vacation", http.StatusInternalServerError)
+		return
+	}
+	used := 0
+	for _, v := range past {
+		if v.covers(now) {
+			http.Error(w, fmt.Sprintf("%s is already on vacation until %s", pet.Name, v.EndsAt.Format(time.RFC3339)), http.StatusConflict)
+			return
+		}
+		if next := v.end().Add(vacationCooldown); now.Before(next) {
+			http.Error(w, fmt.Sprintf("The next vacation can start at %s", next.Format(time.RFC3339)), http.StatusConflict)
+			return
+		}
+		if !v.StartsAt.Before(monthStart) {
+			used += v.days()
+		}
+	}
+	if used+req.Days > maxVacationDaysPerMonth {
+		http.Error(w, fmt.Sprintf("Only %d vacation days are left this month", maxVacationDaysPerMonth-used), http.StatusConflict)
+		return
+	}
+
+	v := &petVacation{PetID: petID, StartedBy: userID, StartsAt: now, EndsAt: now.Add(time.Duration(req.Days) * 24 * time.Hour)}
+	res, err := tx.Exec("INSERT INTO pet_vacations (pet_id, started_by, starts_at, ends_at) VALUES (?, ?, ?, ?)", petID, userID, v.StartsAt, v.EndsAt)
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error starting vacation", http.StatusInternalServerError)
+		return
+	}
+	v.ID, _ = res.LastInsertId()
+	entry, err := recordActivity(tx, petID, userID, activityVacationStarted,
+		fmt.Sprintf("%s sent %s on a %d-day vacation", userDisplayName(tx, userID), pet.Name, req.Days),
+		map[string]interface{}{"vacation_id": v.ID, "days": req.Days, "ends_at": v.EndsAt})
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error starting vacation", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error starting vacation", http.StatusInternalServerError)
+		return
+	}
+
+	publishActivity(entry)
+	for _, ownerID := range pet.ownerIDs() {
+		if ownerID != userID {
+			sendToUser(ownerID, map[string]interface{}{
+				"type":       "VacationStarted",
+				"pet_id":     petID,
+				"started_by": userID,
+				"vacation":   v,
+			})
+		}
+	}
+	logMessage("vacation_started", map[string]interface{}{"pet_id": petID, "user_id": userID, "days": req.Days})
+	writeJSON(w, http.StatusCreated, v)
+}
+
+// endVacationHandler ends a pet's vacation early.
+// Endpoint: DELETE /pets/{id}/vacation
+// Response:
+// - 200 OK with the ended vacation.
+// - 401 Unauthorized if the user is not authenticated.
+// - 403 Forbidden if the caller does not own the pet.
+// - 404 Not Found if the pet does not exist or is not on vacation.
+func endVacationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	petID, ok := petIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Error ending vacation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pet, err := loadPet(tx, petID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Pet not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error reading pet", http.StatusInternalServerError)
+		return
+	}
+	if !pet.isOwner(userID) {
+		http.Error(w, "Only owners can end a pet's vacation", http.StatusForbidden)
+		return
+	}
+	v, entry, err := endVacationTx(tx, pet, userID, vacationEndedByOwner, time.Now())
+	if err != nil {
+		logMessage("vacation_error", map[string]interface{}{"error": err.Error(), "pet_id": petID})
+		http.Error(w, "Error ending vacation", http.StatusInternalServerError)
+		return
+	}
+	if v == nil {
+		http.Error(w, fmt.Sprintf("%s is not on vacation", pet.Name), http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error ending vacation", http.StatusInternalServerError)
+		return
+	}
+
+	publishVacationEnded(pet, v, entry)
+	logMessage("vacation_ended", map[string]interface{}{"pet_id": petID, "user_id": userID, "reason": vacationEndedByOwner})
+	writeJSON(w, http.StatusOK, v)
+}